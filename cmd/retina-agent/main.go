@@ -0,0 +1,172 @@
+// retina-agent serves hub queues from a local HTTP service. It dials
+// out to the hub, so the service needs no inbound ports and can sit
+// behind NAT or on a laptop:
+//
+//	retina-agent -u ws://hub:9391/ -q api -upstream http://localhost:8080
+//	retina-agent -u ws://hub:9391/ -q api -upstream unix:/run/app.sock
+//
+// Each request is forwarded to the upstream with its original method,
+// URI and headers, and the response is returned through the hub.
+// Streamed responses are streamed to the client, reading from the
+// upstream no faster than the client keeps up. The agent reconnects
+// if the hub connection is lost
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/coopernurse/retina/ws"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const maxReconnectWait = 30 * time.Second
+
+// newProxy returns a reverse proxy to upstream, which is an http(s)
+// URL or unix:/path/to/socket
+func newProxy(upstream string) (*httputil.ReverseProxy, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	var target *url.URL
+	if strings.HasPrefix(upstream, "unix:") {
+		sock := strings.TrimPrefix(strings.TrimPrefix(upstream, "unix:"), "//")
+		if sock == "" {
+			return nil, fmt.Errorf("no socket path in upstream: %s", upstream)
+		}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+		target = &url.URL{Scheme: "http", Host: "localhost"}
+	} else {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("upstream must be http(s)://host[:port] or unix:/path: %s", upstream)
+		}
+		target = u
+	}
+
+	return &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// the hub has already set the X-Forwarded headers
+			for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if vals, ok := r.In.Header[name]; ok {
+					r.Out.Header[name] = vals
+				}
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("retina-agent: upstream error:", r.Method, r.URL, err)
+			status := http.StatusBadGateway
+			if r.Context().Err() == context.DeadlineExceeded {
+				status = http.StatusGatewayTimeout
+			}
+			w.Header().Set("X-Hub-Error", retinaws.CodeBackendError)
+			w.Header().Set("X-Hub-Error-Message", "upstream unavailable: "+err.Error())
+			w.WriteHeader(status)
+		},
+	}, nil
+}
+
+// serve runs the backend until stop is closed, redialing the hub with
+// backoff whenever the connection is lost or cannot be made
+func serve(b *retinaws.Backend, stop chan bool) {
+	wait := time.Second
+	for {
+		err := b.Serve(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Println("retina-agent:", err)
+		} else {
+			log.Println("retina-agent: hub connection closed")
+			wait = time.Second
+		}
+		log.Println("retina-agent: reconnecting in", wait)
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > maxReconnectWait {
+			wait = maxReconnectWait
+		}
+	}
+}
+
+func initSignalHandlers(stop chan bool) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		log.Printf("retina-agent: shutting down - got signal: %v\n", sig)
+		close(stop)
+	}()
+}
+
+func main() {
+	var hubUrl string
+	var queues string
+	var upstream string
+	var workers int
+	var version string
+	var maxMessageSize int64
+	var compression retinaws.Compression
+	flag.StringVar(&hubUrl, "u", "ws://localhost:9391/", "Retina websocket endpoint URL")
+	flag.StringVar(&queues, "q", "", "Comma separated queues or queue patterns to serve")
+	flag.StringVar(&upstream, "upstream", "", "Local service: http://host:port or unix:/path/to/socket")
+	flag.IntVar(&workers, "w", 256, "Most requests forwarded at once")
+	flag.StringVar(&version, "v", "", "Backend version label")
+	flag.Int64Var(&maxMessageSize, "maxsize", 0, "Largest request body accepted from the hub. 0 = 4 MiB")
+	flag.BoolVar(&compression.Deflate, "deflate", false, "Negotiate permessage-deflate")
+	flag.StringVar(&compression.Encoding, "z", "", "Encoding for reply bodies, e.g. gzip")
+	flag.IntVar(&compression.MinSize, "zmin", 1024, "Smallest reply body to compress")
+	flag.Parse()
+
+	if queues == "" {
+		log.Fatalln("retina-agent: -q flag not provided")
+	}
+	if upstream == "" {
+		log.Fatalln("retina-agent: -upstream flag not provided")
+	}
+	proxy, err := newProxy(upstream)
+	if err != nil {
+		log.Fatalln("retina-agent:", err)
+	}
+
+	if !strings.HasSuffix(hubUrl, "/") {
+		hubUrl += "/"
+	}
+	b := &retinaws.Backend{
+		URL:            hubUrl + queues,
+		Pool:           retinaws.PoolConfig{MaxWorkers: workers},
+		Version:        version,
+		Compression:    compression,
+		MaxMessageSize: maxMessageSize,
+	}
+	b.Handler = b.HTTPHandler(proxy)
+
+	stop := make(chan bool)
+	initSignalHandlers(stop)
+
+	log.Println("retina-agent: forwarding", queues, "to", upstream)
+	serve(b, stop)
+	log.Println("retina-agent: exiting")
+}
@@ -1,51 +1,220 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/coopernurse/retina/ws"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-func run(url string, workers int, done chan bool, msgs chan string) {
-	handler := func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
-		msgs <- string(body)
-		queue, ok := headers["X-Hub-Queue"]
-		if !ok || len(queue) < 1 {
-			log.Println("backend: message missing X-Hub-Queue header")
-			return map[string][]string{"X-Hub-Status": []string{"500"}}, []byte("Missing X-Hub-Queue header")
-		} else {
-			switch queue[0] {
-			case "echo":
-				return nil, body
-			case "add":
-				parts := strings.Split(string(body), ",")
-				sum := 0
-				for _, part := range parts {
-					x, _ := strconv.Atoi(part)
-					sum += x
-				}
-				return nil, []byte(strconv.Itoa(sum))
-			case "sleep":
-				parts := strings.Split(string(body), ",")
-				if len(parts) == 2 {
-					sleepMillis, _ := strconv.Atoi(parts[0])
-					time.Sleep(time.Duration(sleepMillis) * time.Millisecond)
-				}
-				return nil, body
-			default:
-				return map[string][]string{"X-Hub-Status": []string{"500"}}, []byte("Unknown queue: " + queue[0])
+type sumRequest struct {
+	Numbers []int `json:"numbers"`
+}
+
+func (r sumRequest) Validate() error {
+	if len(r.Numbers) == 0 {
+		return errors.New("numbers is required")
+	}
+	return nil
+}
+
+type sumResponse struct {
+	Sum int `json:"sum"`
+}
+
+func sum(ctx context.Context, req sumRequest) (sumResponse, error) {
+	total := 0
+	for _, n := range req.Numbers {
+		total += n
+	}
+	if total < 0 {
+		return sumResponse{}, &retinaws.HubError{Status: 422, Code: "negative_sum", Message: "sum is negative"}
+	}
+	return sumResponse{Sum: total}, nil
+}
+
+func run(url, queues string, workers int, version string, compression retinaws.Compression, done chan bool, msgs chan string) {
+	b := &retinaws.Backend{
+		Workers:     workers,
+		Version:     version,
+		Compression: compression,
+	}
+
+	mux := retinaws.NewQueueMux()
+	mux.Handle("echo", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		return nil, body
+	})
+	mux.Handle("jobs", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		return nil, nil
+	})
+	mux.Handle("add", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		parts := strings.Split(string(body), ",")
+		sum := 0
+		for _, part := range parts {
+			x, _ := strconv.Atoi(part)
+			sum += x
+		}
+		return nil, []byte(strconv.Itoa(sum))
+	})
+	mux.Handle("sleep", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		parts := strings.Split(string(body), ",")
+		if len(parts) == 2 {
+			sleepMillis, _ := strconv.Atoi(parts[0])
+			time.Sleep(time.Duration(sleepMillis) * time.Millisecond)
+		}
+		return nil, body
+	})
+	mux.Handle("repeat", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		n, _ := strconv.Atoi(string(body))
+		return nil, []byte(strings.Repeat("x", n))
+	})
+	mux.Handle("nested", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		// body is queue:payload - calls queue and returns its reply
+		parts := strings.SplitN(string(body), ":", 2)
+		req := &retinaws.ClientRequest{Queue: parts[0]}
+		if len(parts) == 2 {
+			req.Body = []byte(parts[1])
+		}
+		return call(b, headers, req)
+	})
+	mux.Handle("loop", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		return call(b, headers, &retinaws.ClientRequest{Queue: "loop"})
+	})
+	mux.Handle("chain", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		return nil, []byte(strings.Join(headers["X-Hub-Call-Chain"], ""))
+	})
+	mux.Handle("vars", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		vars := make([]string, 0)
+		for name, val := range headers {
+			if strings.HasPrefix(name, "X-Hub-Var-") && len(val) > 0 {
+				vars = append(vars, name[len("X-Hub-Var-"):]+"="+val[0])
+			}
+		}
+		sort.Strings(vars)
+		return nil, []byte(strings.Join(vars, ","))
+	})
+	mux.Handle("meta", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		meta := make([]string, 0)
+		for _, name := range []string{"X-Hub-Method", "X-Hub-Vhost", "X-Hub-Tls", "X-Forwarded-Proto", "X-Spoofed"} {
+			meta = append(meta, strings.Join(headers[name], ""))
+		}
+		return nil, []byte(strings.Join(meta, ","))
+	})
+	mux.Handle("panic", retinaws.Wrap(func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		panic("boom")
+	}, retinaws.Recover()))
+	mux.Handle("crash", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		panic("unrecovered boom")
+	})
+	mux.Handle("pool", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		stats := b.PoolStats()
+		return nil, []byte(fmt.Sprintf("%d,%d,%d", stats.Workers, stats.Completed, stats.Panics))
+	})
+	mux.Handle("slow", retinaws.Wrap(func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		time.Sleep(time.Second)
+		return nil, body
+	}, retinaws.Timeout(200*time.Millisecond)))
+	metrics := &retinaws.HandlerMetrics{}
+	mux.Handle("metrics", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		stats := metrics.Stats(string(body))
+		return nil, []byte(fmt.Sprintf("%d,%d", stats.Requests, stats.Errors))
+	})
+	mux.Handle("sum", retinaws.JSONHandler(sum))
+	mux.Handle("rpc", retinaws.JSONRPC(map[string]retinaws.RPCMethod{
+		"sum": retinaws.RPCFunc(sum),
+		"add": retinaws.RPCFunc(sum),
+	}))
+	var notes int32
+	mux.Handle("users", retinaws.JSONRPC(map[string]retinaws.RPCMethod{
+		"users.get": retinaws.RPCFunc(func(ctx context.Context, req struct{ ID int }) (map[string]string, error) {
+			return map[string]string{"name": fmt.Sprintf("user%d", req.ID)}, nil
+		}),
+		"users.sleep": retinaws.RPCFunc(func(ctx context.Context, ms int) (int, error) {
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+			return ms, nil
+		}),
+		"users.note": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			return atomic.AddInt32(&notes, 1), nil
+		},
+		"users.notes": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			return atomic.LoadInt32(&notes), nil
+		},
+	}))
+	// flaky fails until heal is called, which returns how many flaky
+	// requests have succeeded since
+	var healed, recovered int32
+	mux.Handle("flaky", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		if atomic.LoadInt32(&healed) == 0 {
+			return map[string][]string{"X-Hub-Status": []string{"500"}}, []byte("not healed")
+		}
+		atomic.AddInt32(&recovered, 1)
+		return nil, body
+	})
+	mux.Handle("heal", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		atomic.StoreInt32(&healed, 1)
+		return nil, []byte(strconv.Itoa(int(atomic.LoadInt32(&recovered))))
+	})
+	mux.HandleRoute("items", "GET", "/items/*", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		return nil, []byte("item " + path.Base(headers["X-Hub-Uri"][0]))
+	})
+	mux.HandleRoute("items", "POST", "/items", func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		return map[string][]string{"X-Hub-Status": []string{"201"}}, body
+	})
+
+	// a plain net/http handler served through the hub
+	web := http.NewServeMux()
+	web.HandleFunc("/api/web", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Query().Get("stream") == "" {
+			w.WriteHeader(201)
+			fmt.Fprintf(w, "hello %s from %s", r.URL.Query().Get("name"), r.Method)
+			return
+		}
+		for i, part := range []string{"one", "two", "three"} {
+			if i > 0 {
+				time.Sleep(300 * time.Millisecond)
 			}
+			fmt.Fprintln(w, part)
+			w.(http.Flusher).Flush()
 		}
+	})
+	mux.Handle("web", b.HTTPHandler(web))
+
+	if queues == "" {
+		b.URL = mux.URL(url)
+	} else {
+		b.URL = url + queues
+	}
+	b.Handler = retinaws.Wrap(func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		msgs <- string(body)
+		return mux.ServeMessage(headers, body)
+	}, retinaws.Logger(slog.New(slog.NewTextHandler(log.Writer(), nil))), metrics.Middleware())
+	b.Run(done)
+}
+
+// call makes a nested call, passing errors back to the caller
+func call(b *retinaws.Backend, parent map[string][]string, req *retinaws.ClientRequest) (map[string][]string, []byte) {
+	resp, err := b.Call(context.Background(), parent, req)
+	if e, ok := err.(*retinaws.HubError); ok {
+		return e.Headers(), nil
+	} else if err != nil {
+		return map[string][]string{"X-Hub-Status": []string{"500"}}, []byte(err.Error())
 	}
-	url = url + "echo,add,sleep"
-	retinaws.BackendServer(url, workers, handler, done)
+	return nil, resp.Body
 }
 
 func initSignalHandlers(done chan bool) {
@@ -64,10 +233,18 @@ func main() {
 	var logFname string
 	var msgFname string
 	var workers int
+	var version string
+	var queues string
+	var compression retinaws.Compression
 	flag.StringVar(&wsUrl, "u", "ws://localhost:9391/", "Retina websocket endpoint URL")
 	flag.StringVar(&logFname, "l", "", "Path to log file to write to")
 	flag.StringVar(&msgFname, "m", "", "Path to msg file to write to")
 	flag.IntVar(&workers, "w", 10, "Number of workers")
+	flag.StringVar(&version, "v", "", "Backend version label")
+	flag.StringVar(&queues, "q", "", "Queues or queue patterns to subscribe to. Default = all")
+	flag.BoolVar(&compression.Deflate, "deflate", false, "Negotiate permessage-deflate")
+	flag.StringVar(&compression.Encoding, "z", "", "Encoding for reply bodies, e.g. gzip")
+	flag.IntVar(&compression.MinSize, "zmin", 1024, "Smallest reply body to compress")
 	flag.Parse()
 
 	if msgFname == "" {
@@ -104,7 +281,7 @@ func main() {
 	}()
 
 	log.Println("backend: starting")
-	run(wsUrl, workers, done, msgs)
+	run(wsUrl, queues, workers, version, compression, done, msgs)
 	close(msgs)
 	msgFile.Sync()
 	log.Println("backend: exiting")
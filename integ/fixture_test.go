@@ -74,15 +74,28 @@ type Fixture struct {
 	benchStart int64
 }
 
-func (me *Fixture) StartRetina(sleepTime time.Duration) {
+func (me *Fixture) StartRetina(sleepTime time.Duration) *CmdRunner {
 	me.writeFile(retinaConfFname, retinaConf)
-	me.runCmd("../bin/retina", "-c", retinaConfFname)
+	r := me.runCmd("../bin/retina", "-c", retinaConfFname)
 	if sleepTime > 0 {
 		time.Sleep(sleepTime)
 	}
+	return r
 }
 
 func (me *Fixture) StartBackend(workers int, sleepTime time.Duration) *Backend {
+	return me.startBackend(workers, "", "", sleepTime)
+}
+
+func (me *Fixture) StartBackendVersion(workers int, version string, sleepTime time.Duration) *Backend {
+	return me.startBackend(workers, version, "", sleepTime)
+}
+
+func (me *Fixture) StartBackendQueues(workers int, queues string, sleepTime time.Duration) *Backend {
+	return me.startBackend(workers, "", queues, sleepTime)
+}
+
+func (me *Fixture) startBackend(workers int, version, queues string, sleepTime time.Duration) *Backend {
 	me.lock.Lock()
 	defer me.lock.Unlock()
 
@@ -91,6 +104,9 @@ func (me *Fixture) StartBackend(workers int, sleepTime time.Duration) *Backend {
 
 	r := me.runCmd("../bin/backend", "-u", "ws://localhost:9391/",
 		"-w", strconv.Itoa(workers),
+		"-v", version,
+		"-q", queues,
+		"-deflate", "-z", "gzip",
 		"-l", logFile,
 		"-m", msgFile)
 
@@ -104,6 +120,21 @@ func (me *Fixture) StartBackend(workers int, sleepTime time.Duration) *Backend {
 	return b
 }
 
+// StartAgent runs retina-agent, forwarding queues to upstream
+func (me *Fixture) StartAgent(queues, upstream string, sleepTime time.Duration) *CmdRunner {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	r := me.runCmd("../bin/retina-agent", "-u", "ws://localhost:9391/",
+		"-q", queues,
+		"-upstream", upstream)
+
+	if sleepTime > 0 {
+		time.Sleep(sleepTime)
+	}
+	return r
+}
+
 func (me *Fixture) RunEchoClient(workers int, runTime time.Duration) {
 	me.runClient(workers, runTime, func() string {
 		s := RandHex(10)
@@ -196,6 +227,24 @@ func (me *Fixture) VerifyMessages() {
 	}
 }
 
+// BackendMessageCounts returns the number of messages each backend received
+func (me *Fixture) BackendMessageCounts() []int {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	counts := make([]int, len(me.Backends))
+	for i, backend := range me.Backends {
+		file, err := os.Open(backend.MsgFile)
+		me.C.Assert(err, IsNil)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			counts[i]++
+		}
+		file.Close()
+	}
+	return counts
+}
+
 func (me *Fixture) Destroy() {
 	for x := len(me.Commands) - 1; x >= 0; x-- {
 		me.Commands[x].Stop()
@@ -268,10 +317,39 @@ var retinaConfFname = "/tmp/retina_test_conf.json"
 var retinaConf = `
 {
    "listen" : "0.0.0.0:9390",
+   "admin"  : { "listen" : "localhost:9392" },
    "websockethubs" : {
        "test-services" : {
            "listen"    : ":9391",
-           "heartbeat" : 2000
+           "heartbeat" : 2000,
+           "nobackendgrace" : 1000,
+           "compression" : { "deflate" : true, "encoding" : "gzip", "minsize" : 1024 },
+           "datadir" : "/tmp/retina_test_wal",
+           "queues" : {
+               "echo" : {
+                   "methods"  : [ "POST" ],
+                   "affinity" : { "header" : "X-User" }
+               },
+               "jobs" : {
+                   "async"   : true,
+                   "durable" : true
+               },
+               "flaky" : {
+                   "async"      : true,
+                   "deadletter" : true,
+                   "retry"      : { "retries" : 1, "backoff" : 50 }
+               },
+               "repeat" : {
+                   "maxbodysize"     : 16,
+                   "maxresponsesize" : 1000
+               },
+               "add" : {
+                   "split" : {
+                       "weights" : { "v1" : 1 },
+                       "match"   : [ { "header" : "X-Canary", "version" : "v2" } ]
+                   }
+               }
+           }
        }
    },
    "vhosts" : {
@@ -279,7 +357,21 @@ var retinaConf = `
            "docroot": "/dev/null",
            "wshub": {
                "/api/" : "test-services"
-           }
+           },
+           "hubroutes": [
+               {
+                   "path"    : "/rest/users/{id}/orders/{order}",
+                   "methods" : [ "GET" ],
+                   "hub"     : "test-services",
+                   "queue"   : "vars"
+               },
+               {
+                   "path"    : "/rpc",
+                   "hub"     : "test-services",
+                   "queue"   : "rpc",
+                   "jsonrpc" : { "methods" : { "add" : "rpc" } }
+               }
+           ]
        }
    }
 }
@@ -1,9 +1,24 @@
 package integ
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coopernurse/retina/ws"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -89,3 +104,833 @@ func (s *S) TestRandomBackendFailureButOneAlwaysRunning(c *C) {
 	f.LogThroughput("TestRandomBackendFailureButOneAlwaysRunning")
 	f.VerifyMessages()
 }
+
+func (s *S) TestNoBackendReturns503(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	// queues get nobackendgrace from hub start to find a backend
+	f.StartRetina(1100 * time.Millisecond)
+	_, err := HTTPReq("POST", "http://localhost:9390/api/echo", "", nil, bytes.NewBufferString("hi"))
+	c.Assert(err, ErrorMatches, ".*503.*")
+}
+
+func (s *S) TestQueueMethodNotAllowed(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(1, 20*time.Millisecond)
+	_, err := HTTPReq("GET", "http://localhost:9390/api/echo", "", nil, nil)
+	c.Assert(err, ErrorMatches, ".*405.*")
+}
+
+func (s *S) TestAffinityKeyPinsBackend(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 0)
+	f.StartBackend(2, 0)
+	f.StartBackend(2, 20*time.Millisecond)
+	headers := map[string]string{"X-User": "alice"}
+	for i := 0; i < 30; i++ {
+		body := RandHex(10)
+		resp, err := HTTPReq("POST", "http://localhost:9390/api/echo", "", headers, bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+		c.Assert(string(resp), Equals, body)
+	}
+	time.Sleep(20 * time.Millisecond)
+	f.Destroy()
+
+	used := 0
+	for _, count := range f.BackendMessageCounts() {
+		if count > 0 {
+			used++
+		}
+	}
+	c.Check(used, Equals, 1)
+}
+
+func (s *S) TestSplitByVersion(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackendVersion(2, "v1", 0)
+	f.StartBackendVersion(2, "v2", 20*time.Millisecond)
+	for i := 0; i < 20; i++ {
+		var headers map[string]string
+		if i%4 == 0 {
+			headers = map[string]string{"X-Canary": "1"}
+		}
+		resp, err := HTTPReq("POST", "http://localhost:9390/api/add", "", headers, bytes.NewBufferString("1,2"))
+		c.Assert(err, IsNil)
+		c.Assert(string(resp), Equals, "3")
+	}
+	time.Sleep(20 * time.Millisecond)
+	f.Destroy()
+
+	counts := f.BackendMessageCounts()
+	c.Check(counts[0], Equals, 15)
+	c.Check(counts[1], Equals, 5)
+}
+
+func (s *S) TestPatternSubscription(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackendQueues(2, "e*,ad*", 20*time.Millisecond)
+	for _, queue := range []string{"echo", "add"} {
+		resp, err := HTTPReq("POST", "http://localhost:9390/api/"+queue, "", nil, bytes.NewBufferString("1"))
+		c.Assert(err, IsNil)
+		c.Assert(string(resp), Equals, "1")
+	}
+
+	// exact subscriptions take precedence over patterns
+	f.StartBackendQueues(2, "echo", 20*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		_, err := HTTPReq("POST", "http://localhost:9390/api/echo", "", nil, bytes.NewBufferString("2"))
+		c.Assert(err, IsNil)
+	}
+	time.Sleep(20 * time.Millisecond)
+	f.Destroy()
+
+	counts := f.BackendMessageCounts()
+	c.Check(counts[0], Equals, 2)
+	c.Check(counts[1], Equals, 10)
+}
+
+func (s *S) TestHubRoutePathVars(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(1, 20*time.Millisecond)
+	resp, err := HTTPReq("GET", "http://localhost:9390/rest/users/42/orders/7", "", nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(string(resp), Equals, "id=42,order=7")
+
+	// other methods fall through to the static handler
+	_, err = HTTPReq("DELETE", "http://localhost:9390/rest/users/42/orders/7", "", nil, nil)
+	c.Check(err, ErrorMatches, ".*404.*")
+}
+
+func (s *S) TestConnectionMetadata(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(1, 20*time.Millisecond)
+	headers := map[string]string{"X-Hub-Spoofed": "1", "Connection": "X-Spoofed", "X-Spoofed": "1"}
+	resp, err := HTTPReq("PUT", "http://localhost:9390/api/meta", "", headers, nil)
+	c.Assert(err, IsNil)
+	c.Check(string(resp), Equals, "PUT,default,off,http,")
+}
+
+func (s *S) TestErrorBody(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	// queues get nobackendgrace from hub start to find a backend
+	f.StartRetina(1100 * time.Millisecond)
+	resp, err := http.Post("http://localhost:9390/api/nobody", "text/plain", bytes.NewBufferString("hi"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	var body struct {
+		Error struct {
+			Code      string
+			Message   string
+			RequestID string `json:"request_id"`
+		}
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&body), IsNil)
+	c.Check(resp.StatusCode, Equals, 503)
+	c.Check(resp.Header.Get("Retry-After"), Equals, "1")
+	c.Check(body.Error.Code, Equals, "no_backend")
+	c.Check(body.Error.RequestID, Equals, resp.Header.Get("X-Request-Id"))
+}
+
+func (s *S) TestBackendErrorBody(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackendQueues(2, "unknown*", 2*time.Second)
+
+	req, _ := http.NewRequest("GET", "http://localhost:9390/api/unknown1", nil)
+	req.Header.Set("Accept", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(resp.Body)
+	c.Check(resp.StatusCode, Equals, 404)
+	c.Check(buf.String(), Equals, "not_found: no handler for queue: unknown1\n")
+}
+
+func (s *S) TestFrameV1Backend(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+
+	// a backend that predates frame negotiation sends no subprotocol
+	ws, _, err := websocket.DefaultDialer.Dial("ws://localhost:9391/legacy", nil)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+	c.Check(ws.Subprotocol(), Equals, "")
+
+	go func() {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		headers, body := retinaws.ParseFrame(data)
+		ack := map[string][]string{"X-Hub-Id": headers["X-Hub-Id"], "X-Hub-ControlOp": {"ack"}}
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.WriteFrame(ack, nil))
+		reply := map[string][]string{"X-Hub-Id": headers["X-Hub-Id"]}
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.WriteFrame(reply, append([]byte("v1:"), body...)))
+	}()
+
+	out, err := HTTPReq("POST", "http://localhost:9390/api/legacy", "", nil, bytes.NewBufferString("hi"))
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, "v1:hi")
+}
+
+func (s *S) TestFrameV2Backend(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+
+	dialer := websocket.Dialer{Subprotocols: []string{retinaws.SubprotocolV2}}
+	ws, _, err := dialer.Dial("ws://localhost:9391/modern", nil)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+	c.Check(ws.Subprotocol(), Equals, retinaws.SubprotocolV2)
+
+	// header names in any case, and values a v1 frame cannot carry
+	go func() {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		req, err := retinaws.FrameV2.Decode(data)
+		if err != nil {
+			return
+		}
+		id := req.Headers["X-Hub-Id"]
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.FrameV2.Encode(&retinaws.Frame{Op: retinaws.OpAck, Headers: map[string][]string{"x-hub-id": id}}))
+		reply := map[string][]string{"x-hub-id": id, "x-hub-status": {"201"}, "x-note": {"line 1\r\nline 2"}}
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.FrameV2.Encode(&retinaws.Frame{Headers: reply, Body: append([]byte("v2:"), req.Body...)}))
+	}()
+
+	resp, err := http.Post("http://localhost:9390/api/modern", "text/plain", strings.NewReader("hi"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	out, _ := ioutil.ReadAll(resp.Body)
+	c.Check(resp.StatusCode, Equals, 201)
+	c.Check(string(out), Equals, "v2:hi")
+	// net/http turns the line break into spaces on the way to the client
+	c.Check(resp.Header.Get("X-Note"), Equals, "line 1  line 2")
+}
+
+func (s *S) TestCompressedBodies(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 2*time.Second)
+
+	// large enough to be gzipped in both directions
+	body := bytes.Repeat([]byte("compress me "), 10000)
+	out, err := HTTPReq("POST", "http://localhost:9390/api/echo", "", nil, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(out, body), Equals, true)
+
+	// a raw v2 backend sees the request frame as sent by the hub
+	dialer := websocket.Dialer{Subprotocols: []string{retinaws.SubprotocolV2}}
+	ws, _, err := dialer.Dial("ws://localhost:9391/modern", nil)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	sent := make(chan *retinaws.Frame, 1)
+	go func() {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			close(sent)
+			return
+		}
+		req, err := retinaws.FrameV2.Decode(data)
+		if err != nil {
+			close(sent)
+			return
+		}
+		sent <- req
+		id := req.Headers["X-Hub-Id"]
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.FrameV2.Encode(&retinaws.Frame{Op: retinaws.OpAck, Headers: map[string][]string{"X-Hub-Id": id}}))
+		reply := map[string][]string{"X-Hub-Id": id, "X-Hub-Content-Encoding": req.Headers["X-Hub-Content-Encoding"]}
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.FrameV2.Encode(&retinaws.Frame{Headers: reply, Body: req.Body}))
+	}()
+
+	out, err = HTTPReq("POST", "http://localhost:9390/api/modern", "", nil, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	req := <-sent
+	c.Assert(req, NotNil)
+	c.Check(req.Headers["X-Hub-Content-Encoding"], DeepEquals, []string{"gzip"})
+	c.Check(len(req.Body) < len(body)/10, Equals, true, Commentf("%d byte frame body", len(req.Body)))
+	// and the hub decompresses the gzipped reply
+	c.Check(bytes.Equal(out, body), Equals, true)
+
+	// bodies below minsize are sent as is
+	go func() {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			close(sent)
+			return
+		}
+		req, err := retinaws.FrameV2.Decode(data)
+		if err != nil {
+			close(sent)
+			return
+		}
+		sent <- req
+		id := map[string][]string{"X-Hub-Id": req.Headers["X-Hub-Id"]}
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.FrameV2.Encode(&retinaws.Frame{Op: retinaws.OpAck, Headers: id}))
+		ws.WriteMessage(websocket.BinaryMessage, retinaws.FrameV2.Encode(&retinaws.Frame{Headers: id, Body: req.Body}))
+	}()
+	out, err = HTTPReq("POST", "http://localhost:9390/api/modern", "", nil, bytes.NewBufferString("small"))
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, "small")
+	req = <-sent
+	c.Assert(req, NotNil)
+	c.Check(req.Headers["X-Hub-Content-Encoding"], IsNil)
+	c.Check(string(req.Body), Equals, "small")
+}
+
+func (s *S) TestSizeLimits(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 2*time.Second)
+
+	post := func(body string) (int, string) {
+		resp, err := http.Post("http://localhost:9390/api/repeat", "text/plain", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		buf := &bytes.Buffer{}
+		buf.ReadFrom(resp.Body)
+		return resp.StatusCode, buf.String()
+	}
+
+	status, _ := post("12345678901234567")
+	c.Check(status, Equals, 413)
+
+	status, body := post("5000")
+	c.Check(status, Equals, 502)
+	c.Check(body, Matches, `.*"code":"response_too_large".*`)
+
+	// the connection survives an oversized reply
+	status, body = post("500")
+	c.Check(status, Equals, 200)
+	c.Check(len(body), Equals, 500)
+}
+
+func (s *S) TestClientCall(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 2*time.Second)
+
+	client := &retinaws.Client{URL: "ws://localhost:9391/"}
+	c.Assert(client.Dial(), IsNil)
+	defer client.Close()
+
+	resp, err := client.Call(context.Background(), "add", []byte("1,2,3"))
+	c.Assert(err, IsNil)
+	c.Check(resp.HTTPStatus, Equals, 200)
+	c.Check(string(resp.Body), Equals, "6")
+
+	resp, err = client.Do(context.Background(), &retinaws.ClientRequest{
+		Queue:   "meta",
+		Method:  "PUT",
+		Headers: map[string][]string{"X-Spoofed": {"yes"}},
+	})
+	c.Assert(err, IsNil)
+	c.Check(string(resp.Body), Equals, "PUT,,off,http,yes")
+
+	_, err = client.Call(context.Background(), "nobody", nil)
+	hubErr, ok := err.(*retinaws.HubError)
+	c.Assert(ok, Equals, true)
+	c.Check(hubErr.Code, Equals, "no_backend")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Call(ctx, "sleep", []byte("1000,x"))
+	c.Check(err, Equals, context.DeadlineExceeded)
+}
+
+func (s *S) TestNestedCalls(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(4, 2*time.Second)
+
+	out, err := HTTPReq("POST", "http://localhost:9390/api/nested", "", nil, bytes.NewBufferString("add:4,5"))
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, "9")
+
+	resp, err := http.Post("http://localhost:9390/api/nested", "text/plain", bytes.NewBufferString("chain:"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(resp.Body)
+	chain := strings.Split(buf.String(), ",")
+	c.Assert(len(chain), Equals, 2)
+	c.Check(chain[0], Equals, resp.Header.Get("X-Request-Id"))
+
+	// a handler calling itself is stopped at the maximum call depth
+	resp, err = http.Post("http://localhost:9390/api/loop", "text/plain", nil)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, 508)
+}
+
+func (s *S) TestQueueMuxRoutes(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 2*time.Second)
+
+	client := &retinaws.Client{URL: "ws://localhost:9391/"}
+	c.Assert(client.Dial(), IsNil)
+	defer client.Close()
+
+	do := func(method, uri string) (*retinaws.Response, error) {
+		return client.Do(context.Background(), &retinaws.ClientRequest{Queue: "items", Method: method, URI: uri, Body: []byte("new")})
+	}
+
+	resp, err := do("GET", "/items/5")
+	c.Assert(err, IsNil)
+	c.Check(string(resp.Body), Equals, "item 5")
+
+	resp, err = do("POST", "/items")
+	c.Assert(err, IsNil)
+	c.Check(resp.HTTPStatus, Equals, 201)
+	c.Check(string(resp.Body), Equals, "new")
+
+	resp, err = do("DELETE", "/items/5")
+	c.Assert(err, NotNil)
+	c.Check(resp.Error.Code, Equals, "method_not_allowed")
+	c.Check(resp.Headers["Allow"], DeepEquals, []string{"GET"})
+
+	_, err = do("GET", "/other")
+	c.Check(err.(*retinaws.HubError).Code, Equals, "not_found")
+}
+
+func (s *S) TestHTTPHandlerBackend(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 2*time.Second)
+
+	resp, err := http.Get("http://localhost:9390/api/web?name=bob")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, 201)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "text/plain")
+	c.Check(string(body), Equals, "hello bob from GET")
+
+	// flushed output reaches the client before the handler returns
+	start := time.Now()
+	resp, err = http.Get("http://localhost:9390/api/web?stream=1")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	first, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(first, Equals, "one\n")
+	c.Check(time.Since(start) < 300*time.Millisecond, Equals, true)
+	rest, _ := ioutil.ReadAll(reader)
+	c.Check(string(rest), Equals, "two\nthree\n")
+}
+
+func (s *S) TestAgentForwardsToUpstream(c *C) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(202)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+	})
+
+	sock := "/tmp/retina_agent_test.sock"
+	os.Remove(sock)
+	l, err := net.Listen("unix", sock)
+	c.Assert(err, IsNil)
+	unixServer := &http.Server{Handler: upstream}
+	go unixServer.Serve(l)
+	defer unixServer.Close()
+
+	tcpServer := httptest.NewServer(upstream)
+	defer tcpServer.Close()
+
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartAgent("agent-unix", "unix:"+sock, 0)
+	f.StartAgent("agent-tcp", tcpServer.URL, 0)
+	f.StartAgent("agent-down", "http://127.0.0.1:1", 2*time.Second)
+
+	for _, queue := range []string{"agent-unix", "agent-tcp"} {
+		resp, err := http.Post("http://localhost:9390/api/"+queue+"?y=1", "text/plain", strings.NewReader("hi"))
+		c.Assert(err, IsNil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, Equals, 202)
+		c.Check(resp.Header.Get("X-Upstream"), Equals, "yes")
+		c.Check(string(body), Equals, "POST /api/"+queue+"?y=1 hi")
+	}
+
+	// an unreachable upstream is reported as a backend error
+	resp, err := http.Get("http://localhost:9390/api/agent-down")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, 502)
+	c.Check(strings.Contains(string(body), `"code":"backend_error","message":"upstream unavailable: `), Equals, true)
+}
+
+func (s *S) TestHandlerMiddleware(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(1, 2*time.Second)
+
+	get := func(queue, body string) (int, string) {
+		resp, err := http.Post("http://localhost:9390/api/"+queue, "text/plain", strings.NewReader(body))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	// a panic fails the request but not the backend's only worker
+	status, body := get("panic", "")
+	c.Check(status, Equals, 500)
+	c.Check(strings.Contains(body, `"code":"internal_error"`), Equals, true)
+	status, body = get("echo", "still up")
+	c.Check(status, Equals, 200)
+	c.Check(body, Equals, "still up")
+
+	start := time.Now()
+	status, body = get("slow", "")
+	c.Check(status, Equals, 504)
+	c.Check(strings.Contains(body, `"code":"timeout"`), Equals, true)
+	c.Check(time.Since(start) < 900*time.Millisecond, Equals, true)
+
+	_, body = get("metrics", "panic")
+	c.Check(body, Equals, "1,1")
+	_, body = get("metrics", "echo")
+	c.Check(body, Equals, "1,0")
+}
+
+func (s *S) TestBackendWorkerPool(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(1, 2*time.Second)
+
+	post := func(queue, body string) (int, string) {
+		resp, err := http.Post("http://localhost:9390/api/"+queue, "text/plain", strings.NewReader(body))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	// a panic without recovery middleware is replied to, and the
+	// backend keeps serving
+	status, body := post("crash", "")
+	c.Check(status, Equals, 500)
+	c.Check(strings.Contains(body, `"code":"internal_error"`), Equals, true)
+	status, body = post("echo", "still up")
+	c.Check(status, Equals, 200)
+	c.Check(body, Equals, "still up")
+
+	// the single worker is joined by more while requests wait
+	start := time.Now()
+	done := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			status, _ := post("sleep", "500,x")
+			done <- status
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		c.Check(<-done, Equals, 200)
+	}
+	c.Check(time.Since(start) < 1500*time.Millisecond, Equals, true)
+
+	_, body = post("pool", "")
+	parts := strings.Split(body, ",")
+	c.Assert(parts, HasLen, 3)
+	workers, _ := strconv.Atoi(parts[0])
+	c.Check(workers >= 5, Equals, true)
+	c.Check(parts[1], Equals, "7")
+	c.Check(parts[2], Equals, "1")
+}
+
+func (s *S) TestJSONHandlers(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 2*time.Second)
+
+	post := func(queue, contentType, accept, body string) (int, string) {
+		req, _ := http.NewRequest("POST", "http://localhost:9390/api/"+queue, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	status, body := post("sum", "application/json", "", `{"numbers":[1,2,3]}`)
+	c.Check(status, Equals, 200)
+	c.Check(body, Equals, `{"sum":6}`)
+
+	errorCode := func(body string) string {
+		var e struct{ Error retinaws.HubError }
+		json.Unmarshal([]byte(body), &e)
+		return e.Error.Code
+	}
+	status, body = post("sum", "application/json", "", `{"numbers":`)
+	c.Check(status, Equals, 400)
+	c.Check(errorCode(body), Equals, "bad_request")
+	status, body = post("sum", "application/json", "", `{}`)
+	c.Check(status, Equals, 400)
+	c.Check(strings.Contains(body, "numbers is required"), Equals, true)
+	status, body = post("sum", "application/json", "", `{"numbers":[1,-5]}`)
+	c.Check(status, Equals, 422)
+	c.Check(errorCode(body), Equals, "negative_sum")
+	status, body = post("sum", "text/plain", "", `{"numbers":[1]}`)
+	c.Check(status, Equals, 415)
+	c.Check(errorCode(body), Equals, "unsupported_media_type")
+	status, _ = post("sum", "application/json", "text/html", `{"numbers":[1]}`)
+	c.Check(status, Equals, 406)
+
+	status, body = post("rpc", "application/json", "", `{"jsonrpc":"2.0","method":"sum","params":{"numbers":[2,3]},"id":7}`)
+	c.Check(status, Equals, 200)
+	c.Check(body, Equals, `{"jsonrpc":"2.0","result":{"sum":5},"id":7}`)
+
+	// errors, notifications and batches
+	status, body = post("rpc", "application/json", "", `[
+		{"jsonrpc":"2.0","method":"sum","params":{"numbers":[1]},"id":"a"},
+		{"jsonrpc":"2.0","method":"sum","params":{"numbers":[1]}},
+		{"jsonrpc":"2.0","method":"sum","params":{},"id":"b"},
+		{"jsonrpc":"2.0","method":"sum","params":{"numbers":[-1]},"id":"c"},
+		{"jsonrpc":"2.0","method":"nope","id":"d"},
+		{"method":"sum","id":"e"}]`)
+	c.Check(status, Equals, 200)
+	var responses []retinaws.RPCResponse
+	c.Assert(json.Unmarshal([]byte(body), &responses), IsNil)
+	c.Assert(responses, HasLen, 5)
+	c.Check(string(responses[0].Result), Equals, `{"sum":1}`)
+	codes := make([]int, 0)
+	for _, resp := range responses[1:] {
+		codes = append(codes, resp.Error.Code)
+	}
+	c.Check(codes, DeepEquals, []int{retinaws.RPCInvalidParams, retinaws.RPCServerError, retinaws.RPCMethodNotFound, retinaws.RPCInvalidRequest})
+	c.Check(responses[2].Error.Data, DeepEquals, map[string]interface{}{"code": "negative_sum", "status": float64(422)})
+
+	status, body = post("rpc", "application/json", "", `{"jsonrpc":"2.0","method":"sum","params":{"numbers":[1]}}`)
+	c.Check(status, Equals, 204)
+	c.Check(body, Equals, "")
+	status, body = post("rpc", "application/json", "", `{"jsonrpc":`)
+	c.Check(status, Equals, 200)
+	c.Check(body, Equals, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`)
+}
+
+func (s *S) TestJSONRPCRoute(c *C) {
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(4, 2*time.Second)
+
+	rpc := func(body string) (int, string) {
+		resp, err := http.Post("http://localhost:9390/rpc", "application/json", strings.NewReader(body))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	// methods route by prefix, the Methods map, or to the route queue
+	status, body := rpc(`{"jsonrpc":"2.0","method":"users.get","params":{"id":3},"id":1}`)
+	c.Check(status, Equals, 200)
+	c.Check(body, Equals, `{"jsonrpc":"2.0","result":{"name":"user3"},"id":1}`)
+	_, body = rpc(`{"jsonrpc":"2.0","method":"add","params":{"numbers":[1,2]},"id":2}`)
+	c.Check(body, Equals, `{"jsonrpc":"2.0","result":{"sum":3},"id":2}`)
+	_, body = rpc(`{"jsonrpc":"2.0","method":"sum","params":{"numbers":[4]},"id":3}`)
+	c.Check(body, Equals, `{"jsonrpc":"2.0","result":{"sum":4},"id":3}`)
+
+	// batch calls run concurrently and come back in order, without
+	// notifications
+	start := time.Now()
+	status, body = rpc(`[
+		{"jsonrpc":"2.0","method":"users.sleep","params":500,"id":"a"},
+		{"jsonrpc":"2.0","method":"users.note"},
+		{"jsonrpc":"2.0","method":"users.sleep","params":400,"id":"b"},
+		{"jsonrpc":"2.0","method":"nobody.home","id":"c"},
+		{"jsonrpc":"2.0","method":"users.missing","id":"d"},
+		{"bogus":true}]`)
+	c.Check(status, Equals, 200)
+	c.Check(time.Since(start) < 900*time.Millisecond, Equals, true)
+	var responses []retinaws.RPCResponse
+	c.Assert(json.Unmarshal([]byte(body), &responses), IsNil)
+	c.Assert(responses, HasLen, 5)
+	ids := make([]string, 0)
+	for _, resp := range responses {
+		ids = append(ids, string(resp.ID))
+	}
+	c.Check(ids, DeepEquals, []string{`"a"`, `"b"`, `"c"`, `"d"`, "null"})
+	c.Check(string(responses[0].Result), Equals, "500")
+	c.Check(string(responses[1].Result), Equals, "400")
+	c.Check(responses[2].Error.Code, Equals, retinaws.RPCServerError)
+	c.Check(responses[2].Error.Data, DeepEquals, map[string]interface{}{"code": "no_backend", "status": float64(503)})
+	c.Check(responses[3].Error.Code, Equals, retinaws.RPCMethodNotFound)
+	c.Check(responses[4].Error.Code, Equals, retinaws.RPCInvalidRequest)
+
+	// notifications are not waited for
+	start = time.Now()
+	status, body = rpc(`{"jsonrpc":"2.0","method":"users.sleep","params":500}`)
+	c.Check(status, Equals, 204)
+	c.Check(body, Equals, "")
+	c.Check(time.Since(start) < 400*time.Millisecond, Equals, true)
+	_, body = rpc(`{"jsonrpc":"2.0","method":"users.notes","id":4}`)
+	c.Check(body, Equals, `{"jsonrpc":"2.0","result":1,"id":4}`)
+
+	_, body = rpc(`[]`)
+	c.Check(strings.Contains(body, `"code":-32600`), Equals, true)
+	_, body = rpc(`{`)
+	c.Check(body, Equals, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`)
+}
+
+func (s *S) TestDurableQueueSurvivesRestart(c *C) {
+	os.RemoveAll("/tmp/retina_test_wal")
+	f = NewFixture(c)
+	defer f.Destroy()
+
+	// jobs accepted with no backend connected are kept on disk
+	retina := f.StartRetina(20 * time.Millisecond)
+	for _, job := range []string{"job-1", "job-2", "job-3"} {
+		resp, err := http.Post("http://localhost:9390/api/jobs", "text/plain", strings.NewReader(job))
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, Equals, 202)
+	}
+	retina.Stop()
+
+	readMsgs := func(b *Backend) []string {
+		data, err := ioutil.ReadFile(b.MsgFile)
+		c.Assert(err, IsNil)
+		msgs := strings.Fields(string(data))
+		sort.Strings(msgs)
+		return msgs
+	}
+
+	// and delivered after a restart
+	retina = f.StartRetina(20 * time.Millisecond)
+	b := f.StartBackend(1, 2*time.Second)
+	c.Check(readMsgs(b), DeepEquals, []string{"job-1", "job-2", "job-3"})
+	retina.Stop()
+
+	// but only once
+	f.StartRetina(20 * time.Millisecond)
+	b = f.StartBackend(1, 2*time.Second)
+	c.Check(readMsgs(b), DeepEquals, []string{})
+}
+
+func (s *S) TestDeadLetters(c *C) {
+	os.RemoveAll("/tmp/retina_test_wal")
+	f = NewFixture(c)
+	defer f.Destroy()
+	f.StartRetina(20 * time.Millisecond)
+	f.StartBackend(2, 2*time.Second)
+
+	admin := func(method, path string) (int, map[string]json.RawMessage) {
+		req, err := http.NewRequest(method, "http://localhost:9392/hubs/test-services/deadletters"+path, nil)
+		c.Assert(err, IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		var body map[string]json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	type deadLetter struct {
+		ID       string
+		URI      string
+		Body     []byte
+		Attempts int
+		Status   int
+		Error    string
+	}
+	list := func() []deadLetter {
+		status, body := admin("GET", "/flaky")
+		c.Assert(status, Equals, 200)
+		var letters []deadLetter
+		c.Assert(json.Unmarshal(body["deadletters"], &letters), IsNil)
+		return letters
+	}
+
+	// requests still failing once their retry is spent are dead-lettered
+	for _, job := range []string{"job-1", "job-2", "job-3"} {
+		resp, err := http.Post("http://localhost:9390/api/flaky", "text/plain", strings.NewReader(job))
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, Equals, 202)
+	}
+	var letters []deadLetter
+	for i := 0; i < 40 && len(letters) < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		letters = list()
+	}
+	c.Assert(letters, HasLen, 3)
+	bodies := make([]string, 0)
+	for _, letter := range letters {
+		bodies = append(bodies, string(letter.Body))
+		c.Check(letter.URI, Equals, "/api/flaky")
+		c.Check(letter.Attempts, Equals, 2)
+		c.Check(letter.Status, Equals, 500)
+		c.Check(letter.Error, Equals, "not healed")
+	}
+	sort.Strings(bodies)
+	c.Check(bodies, DeepEquals, []string{"job-1", "job-2", "job-3"})
+
+	status, body := admin("GET", "")
+	c.Check(status, Equals, 200)
+	c.Check(string(body["queues"]), Equals, `{"flaky":3}`)
+
+	// purge one, then replay the others once the backend recovers
+	status, body = admin("DELETE", "/flaky?id="+letters[0].ID)
+	c.Check(status, Equals, 200)
+	c.Check(string(body["purged"]), Equals, "1")
+	c.Check(list(), HasLen, 2)
+
+	healed, err := HTTPReq("GET", "http://localhost:9390/api/heal", "", nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(string(healed), Equals, "0")
+	status, body = admin("POST", "/flaky/replay")
+	c.Check(status, Equals, 200)
+	c.Check(string(body["replayed"]), Equals, "2")
+	c.Check(list(), HasLen, 0)
+	for i := 0; i < 40 && string(healed) != "2"; i++ {
+		time.Sleep(50 * time.Millisecond)
+		healed, err = HTTPReq("GET", "http://localhost:9390/api/heal", "", nil, nil)
+		c.Assert(err, IsNil)
+	}
+	c.Check(string(healed), Equals, "2")
+
+	resp, err := http.Get("http://localhost:9392/hubs/nohub/deadletters")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, 404)
+}
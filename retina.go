@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/coopernurse/retina/ws"
 	"github.com/gorilla/mux"
 	"gopkg.in/project-iris/iris-go.v1"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -25,9 +27,268 @@ type RpcConf struct {
 	Timeout int
 }
 
+type RetryConf struct {
+	Retries *int
+	Backoff *int
+}
+
+// AffinityConf pins requests to a backend by header, cookie or
+// 1 based URL path segment
+type AffinityConf struct {
+	Header  string
+	Cookie  string
+	Segment int
+}
+
+// MatchConf routes requests with a matching header to a backend version
+type MatchConf struct {
+	Header  string
+	Value   string
+	Version string
+}
+
+// SplitConf divides traffic between backend versions by weight
+// or header match
+type SplitConf struct {
+	Weights map[string]int
+	Match   []MatchConf
+}
+
+func (c SplitConf) split() retinaws.TrafficSplit {
+	split := retinaws.TrafficSplit{Weights: c.Weights}
+	for _, m := range c.Match {
+		split.Match = append(split.Match, retinaws.VersionMatch{
+			Header:  m.Header,
+			Value:   m.Value,
+			Version: m.Version,
+		})
+	}
+	return split
+}
+
+// QueueConf holds per-queue hub settings. Durations are in
+// milliseconds and 0 leaves a setting unlimited or defaulted. Unset
+// (null) settings are inherited from the hub level, so a queue can
+// turn off a hub default with an explicit false, 0, [] or {}
+type QueueConf struct {
+	Timeout         *int
+	MaxBodySize     *int64
+	MaxResponseSize *int64
+	MaxPending      *int
+	MaxWait         *int
+	CodelTarget     *int
+	CodelInterval   *int
+	NoBackendGrace  *int
+	RetryAfter      *int
+	Methods         []string
+	Retry           RetryConf
+	Async           *bool
+	Durable         *bool
+	DeadLetter      *bool
+	PriorityAging   *int
+	Affinity        *AffinityConf
+	Split           *SplitConf
+	Mirror          *string
+}
+
+// inherit sets an unset setting to its default
+func inherit[T any](v **T, def *T) {
+	if *v == nil {
+		*v = def
+	}
+}
+
+// valueOf returns the setting, or its zero value if unset
+func valueOf[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
+// withDefaults fills unset fields from the hub level defaults
+func (c QueueConf) withDefaults(d QueueConf) QueueConf {
+	inherit(&c.Timeout, d.Timeout)
+	inherit(&c.MaxBodySize, d.MaxBodySize)
+	inherit(&c.MaxResponseSize, d.MaxResponseSize)
+	inherit(&c.MaxPending, d.MaxPending)
+	inherit(&c.MaxWait, d.MaxWait)
+	inherit(&c.CodelTarget, d.CodelTarget)
+	inherit(&c.CodelInterval, d.CodelInterval)
+	inherit(&c.NoBackendGrace, d.NoBackendGrace)
+	inherit(&c.RetryAfter, d.RetryAfter)
+	inherit(&c.Retry.Retries, d.Retry.Retries)
+	inherit(&c.Retry.Backoff, d.Retry.Backoff)
+	inherit(&c.Async, d.Async)
+	inherit(&c.Durable, d.Durable)
+	inherit(&c.DeadLetter, d.DeadLetter)
+	inherit(&c.PriorityAging, d.PriorityAging)
+	inherit(&c.Affinity, d.Affinity)
+	inherit(&c.Split, d.Split)
+	inherit(&c.Mirror, d.Mirror)
+	if c.Methods == nil {
+		c.Methods = d.Methods
+	}
+	return c
+}
+
+func millis(ms int) time.Duration {
+	return time.Millisecond * time.Duration(ms)
+}
+
+func (c QueueConf) config() retinaws.QueueConfig {
+	affinity := valueOf(c.Affinity)
+	return retinaws.QueueConfig{
+		QueueLimits: retinaws.QueueLimits{
+			MaxPending:     valueOf(c.MaxPending),
+			MaxWait:        millis(valueOf(c.MaxWait)),
+			CodelTarget:    millis(valueOf(c.CodelTarget)),
+			CodelInterval:  millis(valueOf(c.CodelInterval)),
+			NoBackendGrace: millis(valueOf(c.NoBackendGrace)),
+			RetryAfter:     valueOf(c.RetryAfter),
+		},
+		Timeout:         millis(valueOf(c.Timeout)),
+		MaxBodySize:     valueOf(c.MaxBodySize),
+		MaxResponseSize: valueOf(c.MaxResponseSize),
+		Methods:         c.Methods,
+		Retry: retinaws.RetryPolicy{
+			Retries: valueOf(c.Retry.Retries),
+			Backoff: millis(valueOf(c.Retry.Backoff)),
+		},
+		Async:         valueOf(c.Async),
+		Durable:       valueOf(c.Durable),
+		DeadLetter:    valueOf(c.DeadLetter),
+		PriorityAging: millis(valueOf(c.PriorityAging)),
+		Affinity: retinaws.AffinityKey{
+			Header:  affinity.Header,
+			Cookie:  affinity.Cookie,
+			Segment: affinity.Segment,
+		},
+		Split:  valueOf(c.Split).split(),
+		Mirror: valueOf(c.Mirror),
+	}
+}
+
 type WsHubConf struct {
-	Listen    string
-	Heartbeat int
+	Listen string
+
+	// Ping interval and liveness timeout for backend connections,
+	// in milliseconds. A timeout of 0 is 2.5 intervals
+	Heartbeat        int
+	HeartbeatTimeout int
+
+	// Compression of traffic between the hub and its backends
+	Compression CompressionConf
+
+	// Largest request or reply body sent to or accepted from
+	// backends, in bytes. Default and upper bound for the per-queue
+	// size limits
+	MaxMessageSize int64
+
+	// Directory for the logs of durable async queues. Required for
+	// Durable to take effect. Dead letters are kept in its deadletter
+	// subdirectory, or only in memory if unset
+	Datadir string
+
+	// Most dead letters kept per queue. 0 = 1000
+	MaxDeadLetters int
+
+	// Defaults for all queues on the hub
+	QueueConf
+
+	// Per-queue overrides, keyed by queue name
+	Queues map[string]QueueConf
+}
+
+// newRouter builds a hub router with the configured queue settings
+func (c WsHubConf) newRouter() *retinaws.Router {
+	defaults := c.QueueConf.withDefaults(QueueConf{
+		MaxBodySize:     &c.MaxMessageSize,
+		MaxResponseSize: &c.MaxMessageSize,
+	})
+	router := retinaws.NewRouter()
+	router.Defaults = defaults.config()
+	router.MaxMessageSize = c.MaxMessageSize
+	for name, qconf := range c.Queues {
+		router.Configure(name, qconf.withDefaults(defaults).config())
+	}
+	return router
+}
+
+// CompressionConf enables permessage-deflate and compression of
+// frame bodies of at least MinSize bytes with Encoding (e.g. gzip)
+type CompressionConf struct {
+	Deflate  bool
+	Encoding string
+	MinSize  int
+}
+
+func (c CompressionConf) compression() retinaws.Compression {
+	return retinaws.Compression{
+		Deflate:  c.Deflate,
+		Encoding: c.Encoding,
+		MinSize:  c.MinSize,
+	}
+}
+
+// PriorityConf controls the priority of requests sent to hubs.
+// Clients may pick a priority within Min..Max via Header
+type PriorityConf struct {
+	Header  string
+	Min     int
+	Max     int
+	Default int
+
+	// Fixed priority per Wshub or Hubroutes path, ignoring Header
+	Routes map[string]int
+}
+
+// validate rejects a Header without a range to pick from, which
+// would clamp every client supplied priority to the same value
+func (c PriorityConf) validate() error {
+	if c.Header != "" && c.Max <= c.Min {
+		return fmt.Errorf("priority header %s needs max above min, got %d..%d", c.Header, c.Min, c.Max)
+	}
+	return nil
+}
+
+func (c PriorityConf) policy(path string) retinaws.PriorityPolicy {
+	fixed, ok := c.Routes[path]
+	if ok {
+		return retinaws.PriorityPolicy{Default: fixed}
+	}
+	return retinaws.PriorityPolicy{
+		Header:  c.Header,
+		Min:     c.Min,
+		Max:     c.Max,
+		Default: c.Default,
+	}
+}
+
+// HubRouteConf binds a path template (gorilla/mux syntax, e.g.
+// /api/users/{id}/orders) and methods to a queue on a hub
+type HubRouteConf struct {
+	Path    string
+	Methods []string
+	Hub     string
+	Queue   string
+
+	// If set, bodies are parsed as JSON-RPC 2.0 and each call is
+	// routed by method. Queue is then the queue for methods without
+	// a dot, e.g. ping. Methods defaults to POST
+	Jsonrpc *JsonRpcConf
+}
+
+// JsonRpcConf routes JSON-RPC calls on a hub route. A method such as
+// users.get goes to queue users unless listed in Methods
+type JsonRpcConf struct {
+	// Queue by method name. A queue reached by method prefix that
+	// takes larger bodies than the route's queue needs an entry here
+	Methods map[string]string
+
+	// Most calls in a batch. 0 = 100
+	MaxBatch int
 }
 
 type Vhost struct {
@@ -36,14 +297,23 @@ type Vhost struct {
 	Rpc       RpcConf
 	Proxy     map[string]string
 	Wshub     map[string]string
+	Hubroutes []HubRouteConf
+	Priority  PriorityConf
 	Aliases   map[string]string
 }
 
+type AdminConf struct {
+	// Address of the admin API, e.g. for managing dead letters. It is
+	// unauthenticated, so keep it private. Empty = off
+	Listen string
+}
+
 type Config struct {
 	Listen        string
 	Irisport      int
 	Vhosts        map[string]Vhost
 	Websockethubs map[string]WsHubConf
+	Admin         AdminConf
 }
 
 func loadConfig(filename string) (conf Config, err error) {
@@ -53,6 +323,15 @@ func loadConfig(filename string) (conf Config, err error) {
 	}
 
 	err = json.Unmarshal(b, &conf)
+	if err != nil {
+		return
+	}
+	for name, vhost := range conf.Vhosts {
+		if err = vhost.Priority.validate(); err != nil {
+			err = fmt.Errorf("vhost %s: %v", name, err)
+			return
+		}
+	}
 	return
 }
 
@@ -136,8 +415,9 @@ func addRpcHandler(r *mux.Router, host string, rpc RpcConf, relayConn *iris.Conn
 	}
 }
 
-func addWsHubHandler(r *mux.Router, host string, paths map[string]string, wsHubs map[string]*retinaws.External) {
-	for path, wshubName := range paths {
+func addWsHubHandler(r *mux.Router, vhostName, host string, paths map[string]string, priority PriorityConf, wsHubs map[string]*retinaws.External) {
+	for hubPath, wshubName := range paths {
+		path := hubPath
 		if !strings.HasSuffix(path, "/") {
 			path += "/"
 		}
@@ -146,13 +426,41 @@ func addWsHubHandler(r *mux.Router, host string, paths map[string]string, wsHubs
 		gateway, ok := wsHubs[wshubName]
 		if ok {
 			log.Println("Configuring", nameForHost(host), "with WsHub path:", path)
-			addHostToRoute(host, r.Handle(path, gateway)).Methods("GET", "POST", "PUT", "HEAD", "DELETE")
+			route := &retinaws.Route{External: gateway, Vhost: vhostName, Priority: priority.policy(hubPath)}
+			addHostToRoute(host, r.Handle(path, route)).Methods("GET", "POST", "PUT", "HEAD", "DELETE")
 		} else {
 			log.Println("Error: No websockethubs found with name:", wshubName)
 		}
 	}
 }
 
+func addHubRoutes(r *mux.Router, vhostName, host string, routes []HubRouteConf, priority PriorityConf, wsHubs map[string]*retinaws.External) {
+	for _, rc := range routes {
+		gateway, ok := wsHubs[rc.Hub]
+		if !ok {
+			log.Println("Error: No websockethubs found with name:", rc.Hub)
+			continue
+		}
+
+		route := &retinaws.Route{External: gateway, Queue: rc.Queue, Vhost: vhostName, Priority: priority.policy(rc.Path)}
+		var handler http.Handler = route
+		methods := rc.Methods
+		if rc.Jsonrpc != nil {
+			log.Println("Configuring", nameForHost(host), "with JSON-RPC hub route:", rc.Path)
+			handler = &retinaws.RPCRoute{Route: *route, Methods: rc.Jsonrpc.Methods, MaxBatch: rc.Jsonrpc.MaxBatch}
+			if len(methods) == 0 {
+				methods = []string{"POST"}
+			}
+		} else {
+			log.Println("Configuring", nameForHost(host), "with hub route:", rc.Methods, rc.Path, "to queue:", rc.Queue)
+		}
+		muxRoute := addHostToRoute(host, r.Handle(rc.Path, handler))
+		if len(methods) > 0 {
+			muxRoute.Methods(methods...)
+		}
+	}
+}
+
 func addStaticHandler(r *mux.Router, host, docroot string, aliases map[string]string) {
 	for alias, aliasroot := range aliases {
 		log.Println("Adding alias", nameForHost(host), alias, " with docroot:", aliasroot)
@@ -180,11 +488,12 @@ func addProxyHandlers(r *mux.Router, host string, proxy map[string]string) {
 	}
 }
 
-func addVhost(r *mux.Router, vhost Vhost, isDefault bool, relayConn *iris.Connection, wsHubs map[string]*retinaws.External) {
+func addVhost(r *mux.Router, name string, vhost Vhost, isDefault bool, relayConn *iris.Connection, wsHubs map[string]*retinaws.External) {
 	for _, host := range vhost.Hostnames {
 		addRpcHandler(r, host, vhost.Rpc, relayConn)
 		addProxyHandlers(r, host, vhost.Proxy)
-		addWsHubHandler(r, host, vhost.Wshub, wsHubs)
+		addHubRoutes(r, name, host, vhost.Hubroutes, vhost.Priority, wsHubs)
+		addWsHubHandler(r, name, host, vhost.Wshub, vhost.Priority, wsHubs)
 
 		// this must be last - will serve all other paths
 		addStaticHandler(r, host, vhost.Docroot, vhost.Aliases)
@@ -193,7 +502,8 @@ func addVhost(r *mux.Router, vhost Vhost, isDefault bool, relayConn *iris.Connec
 	if isDefault {
 		addRpcHandler(r, "", vhost.Rpc, relayConn)
 		addProxyHandlers(r, "", vhost.Proxy)
-		addWsHubHandler(r, "", vhost.Wshub, wsHubs)
+		addHubRoutes(r, name, "", vhost.Hubroutes, vhost.Priority, wsHubs)
+		addWsHubHandler(r, name, "", vhost.Wshub, vhost.Priority, wsHubs)
 		addStaticHandler(r, "", vhost.Docroot, vhost.Aliases)
 	}
 }
@@ -206,12 +516,12 @@ func initRouter(conf Config, relayConn *iris.Connection, wsHubs map[string]*reti
 		if name == "default" {
 			addDefault = true
 		} else {
-			addVhost(r, vhost, false, relayConn, wsHubs)
+			addVhost(r, name, vhost, false, relayConn, wsHubs)
 		}
 	}
 
 	if addDefault {
-		addVhost(r, conf.Vhosts["default"], true, relayConn, wsHubs)
+		addVhost(r, "default", conf.Vhosts["default"], true, relayConn, wsHubs)
 	}
 
 	return r
@@ -247,8 +557,39 @@ func main() {
 
 	wsHubs := make(map[string]*retinaws.External)
 	for name, wsconf := range conf.Websockethubs {
-		internalHttp := retinaws.NewInternal()
+		internalHttp := &retinaws.Internal{
+			Router: wsconf.newRouter(),
+			Heartbeat: retinaws.Heartbeat{
+				Interval: millis(wsconf.Heartbeat),
+				Timeout:  millis(wsconf.HeartbeatTimeout),
+			},
+			Compression:    wsconf.Compression.compression(),
+			MaxMessageSize: wsconf.MaxMessageSize,
+		}
 		wsHubs[name] = &retinaws.External{Router: internalHttp.Router, Timeout: 30 * time.Second}
+		if wsconf.Datadir != "" {
+			store, err := retinaws.OpenDurableStore(wsconf.Datadir)
+			if err != nil {
+				log.Fatalln("Unable to open durable queue logs in", wsconf.Datadir, "-", err)
+			}
+			defer store.Close()
+			wsHubs[name].Durable = store
+
+			deadLetters, err := retinaws.OpenDeadLetterStore(filepath.Join(wsconf.Datadir, "deadletter"))
+			if err != nil {
+				log.Fatalln("Unable to open dead letter logs in", wsconf.Datadir, "-", err)
+			}
+			defer deadLetters.Close()
+			wsHubs[name].DeadLetters = deadLetters
+		} else {
+			wsHubs[name].DeadLetters = &retinaws.DeadLetterStore{}
+		}
+		wsHubs[name].DeadLetters.MaxPerQueue = wsconf.MaxDeadLetters
+		// once requests that fail again can be dead-lettered
+		wsHubs[name].ReplayDurable()
+
+		// services connected to the hub may call its queues directly
+		internalHttp.External = wsHubs[name]
 
 		go func() {
 			log.Println("WS Listiner starting on:", wsconf.Listen)
@@ -268,6 +609,16 @@ func main() {
 		defer relayConn.Close()
 	}
 
+	if conf.Admin.Listen != "" {
+		go func() {
+			log.Println("Admin API listening on:", conf.Admin.Listen)
+			err := http.ListenAndServe(conf.Admin.Listen, retinaws.NewAdmin(wsHubs))
+			if err != nil {
+				log.Fatalln("Unable to start admin listener", conf.Admin.Listen, "-", err)
+			}
+		}()
+	}
+
 	router := initRouter(conf, relayConn, wsHubs)
 
 	log.Println("HTTP server listening on:", conf.Listen)
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ConfSuite struct{}
+
+var _ = Suite(&ConfSuite{})
+
+func (s *ConfSuite) TestQueueOverridesHubDefaults(c *C) {
+	var conf WsHubConf
+	c.Assert(json.Unmarshal([]byte(`{
+		"async"      : true,
+		"durable"    : true,
+		"deadletter" : true,
+		"timeout"    : 5000,
+		"methods"    : [ "POST" ],
+		"retry"      : { "retries" : 3, "backoff" : 100 },
+		"queues" : {
+			"inherits" : {},
+			"optout"   : {
+				"async"      : false,
+				"durable"    : false,
+				"deadletter" : false,
+				"methods"    : [],
+				"retry"      : { "retries" : 0 }
+			}
+		}
+	}`), &conf), IsNil)
+	router := conf.newRouter()
+
+	inherits := router.Config("inherits")
+	c.Check(inherits.Async, Equals, true)
+	c.Check(inherits.Durable, Equals, true)
+	c.Check(inherits.DeadLetter, Equals, true)
+	c.Check(inherits.Methods, DeepEquals, []string{"POST"})
+	c.Check(inherits.Retry.Retries, Equals, 3)
+	c.Check(inherits.Timeout, Equals, 5*time.Second)
+
+	optout := router.Config("optout")
+	c.Check(optout.Async, Equals, false)
+	c.Check(optout.Durable, Equals, false)
+	c.Check(optout.DeadLetter, Equals, false)
+	c.Check(optout.Methods, HasLen, 0)
+	c.Check(optout.Retry.Retries, Equals, 0)
+	c.Check(optout.Retry.Backoff, Equals, 100*time.Millisecond)
+	c.Check(optout.Timeout, Equals, 5*time.Second)
+
+	c.Check(router.Config("unconfigured").Async, Equals, true)
+}
+
+func (s *ConfSuite) TestBodySizeLimitedToMessageSize(c *C) {
+	var conf WsHubConf
+	c.Assert(json.Unmarshal([]byte(`{
+		"maxmessagesize" : 1024,
+		"queues" : {
+			"big"   : { "maxbodysize" : 4096 },
+			"small" : { "maxbodysize" : 512 }
+		}
+	}`), &conf), IsNil)
+	router := conf.newRouter()
+	c.Check(router.Config("big").MaxBodySize, Equals, int64(1024))
+	c.Check(router.Config("small").MaxBodySize, Equals, int64(512))
+	c.Check(router.Config("unconfigured").MaxBodySize, Equals, int64(1024))
+}
+
+func (s *ConfSuite) TestPriorityHeaderNeedsRange(c *C) {
+	load := func(priority string) error {
+		file := filepath.Join(c.MkDir(), "retina.json")
+		c.Assert(os.WriteFile(file, []byte(`{"vhosts": {"default": {"priority": `+priority+`}}}`), 0644), IsNil)
+		_, err := loadConfig(file)
+		return err
+	}
+	c.Check(load(`{"header": "X-Priority"}`), ErrorMatches, "vhost default: priority header X-Priority needs max above min, got 0..0")
+	c.Check(load(`{"header": "X-Priority", "min": 5, "max": 1}`), NotNil)
+	c.Check(load(`{"header": "X-Priority", "min": -10, "max": 10}`), IsNil)
+	c.Check(load(`{"default": 3}`), IsNil)
+}
@@ -5,4 +5,5 @@ set -e
 mkdir -p bin
 go build -o bin/retina  retina.go
 go build -o bin/backend ./integ/bin/backend.go
+go build -o bin/retina-agent ./cmd/retina-agent
 go test -v ./integ -gocheck.v
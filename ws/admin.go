@@ -0,0 +1,183 @@
+package retinaws
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Admin serves the hub admin API. It is unauthenticated, so listen
+// on an address only operators can reach:
+//
+//	GET    /hubs/{hub}/deadletters                 queues holding dead letters, with counts
+//	GET    /hubs/{hub}/deadletters/{queue}         dead letters on queue, oldest first
+//	POST   /hubs/{hub}/deadletters/{queue}/replay  send dead letters back to queue
+//	DELETE /hubs/{hub}/deadletters/{queue}         purge dead letters
+//	GET    /hubs/{hub}/mirrors                     mirrored queues compared with their shadows
+//
+// Replay and purge act on the dead letters named by id query
+// parameters, or on all of the queue's
+type Admin struct {
+	// Hubs by name
+	Hubs map[string]*External
+
+	router *mux.Router
+}
+
+// NewAdmin returns the admin API for hubs
+func NewAdmin(hubs map[string]*External) *Admin {
+	me := &Admin{Hubs: hubs, router: mux.NewRouter()}
+	me.router.HandleFunc("/hubs/{hub}/deadletters", me.deadLetterCounts).Methods("GET")
+	me.router.HandleFunc("/hubs/{hub}/deadletters/{queue}", me.listDeadLetters).Methods("GET")
+	me.router.HandleFunc("/hubs/{hub}/deadletters/{queue}/replay", me.replayDeadLetters).Methods("POST")
+	me.router.HandleFunc("/hubs/{hub}/deadletters/{queue}", me.purgeDeadLetters).Methods("DELETE")
+	me.router.HandleFunc("/hubs/{hub}/mirrors", me.mirrorStats).Methods("GET")
+	me.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, newError(404, CodeNotFound, "no admin endpoint at: "+req.URL.Path))
+	})
+	me.router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, newError(405, CodeMethodNotAllowed, req.Method+" not allowed on: "+req.URL.Path))
+	})
+	return me
+}
+
+func (me *Admin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	me.router.ServeHTTP(w, req)
+}
+
+// deadLetterJSON is a dead letter as listed by the admin API
+type deadLetterJSON struct {
+	ID          string              `json:"id"`
+	Queue       string              `json:"queue"`
+	Method      string              `json:"method"`
+	URI         string              `json:"uri"`
+	Headers     map[string][]string `json:"headers"`
+	Body        []byte              `json:"body"`
+	Priority    int                 `json:"priority,omitempty"`
+	AffinityKey string              `json:"affinity_key,omitempty"`
+	Version     string              `json:"version,omitempty"`
+	Accepted    time.Time           `json:"accepted"`
+	Failed      time.Time           `json:"failed"`
+	Attempts    int                 `json:"attempts"`
+	Status      int                 `json:"status"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// mirrorJSON compares a mirrored queue with its shadow. Latencies
+// are means in milliseconds
+type mirrorJSON struct {
+	Requests       int     `json:"requests"`
+	StatusDiffs    int     `json:"status_diffs"`
+	PrimaryLatency float64 `json:"primary_latency_ms"`
+	ShadowLatency  float64 `json:"shadow_latency_ms"`
+	LatencyDiff    float64 `json:"latency_diff_ms"`
+}
+
+// hub returns the hub named in the request path, replying 404 if
+// there is none
+func (me *Admin) hub(w http.ResponseWriter, req *http.Request) *External {
+	name := mux.Vars(req)["hub"]
+	hub, ok := me.Hubs[name]
+	if !ok {
+		writeError(w, req, newError(404, CodeNotFound, "no such hub: "+name))
+		return nil
+	}
+	return hub
+}
+
+// deadLetters returns the hub named in the request path and its dead
+// letters, replying 404 if there are none
+func (me *Admin) deadLetters(w http.ResponseWriter, req *http.Request) (*External, *DeadLetterStore) {
+	hub := me.hub(w, req)
+	if hub == nil {
+		return nil, nil
+	}
+	if hub.DeadLetters == nil {
+		writeError(w, req, newError(404, CodeNotFound, "no dead letters kept on hub: "+mux.Vars(req)["hub"]))
+		return nil, nil
+	}
+	return hub, hub.DeadLetters
+}
+
+func (me *Admin) deadLetterCounts(w http.ResponseWriter, req *http.Request) {
+	if _, store := me.deadLetters(w, req); store != nil {
+		writeJSON(w, map[string]interface{}{"queues": store.Counts()})
+	}
+}
+
+func (me *Admin) listDeadLetters(w http.ResponseWriter, req *http.Request) {
+	_, store := me.deadLetters(w, req)
+	if store == nil {
+		return
+	}
+	entries := store.List(mux.Vars(req)["queue"])
+	letters := make([]deadLetterJSON, 0, len(entries))
+	for _, e := range entries {
+		letters = append(letters, deadLetterJSON{
+			ID:          e.ID,
+			Queue:       e.Queue,
+			Method:      e.HTTPMethod,
+			URI:         e.HTTPURI,
+			Headers:     e.Headers,
+			Body:        e.Body,
+			Priority:    e.Priority,
+			AffinityKey: e.AffinityKey,
+			Version:     e.Version,
+			Accepted:    e.Accepted,
+			Failed:      e.Failed,
+			Attempts:    e.Attempts,
+			Status:      e.Status,
+			Error:       e.Error,
+		})
+	}
+	writeJSON(w, map[string]interface{}{"deadletters": letters})
+}
+
+func (me *Admin) replayDeadLetters(w http.ResponseWriter, req *http.Request) {
+	hub, store := me.deadLetters(w, req)
+	if store == nil {
+		return
+	}
+	replayed, kept := hub.ReplayDeadLetters(mux.Vars(req)["queue"], req.URL.Query()["id"]...)
+	writeJSON(w, map[string]int{"replayed": replayed, "kept": kept})
+}
+
+func (me *Admin) purgeDeadLetters(w http.ResponseWriter, req *http.Request) {
+	_, store := me.deadLetters(w, req)
+	if store == nil {
+		return
+	}
+	purged := store.Purge(mux.Vars(req)["queue"], req.URL.Query()["id"]...)
+	writeJSON(w, map[string]int{"purged": purged})
+}
+
+func (me *Admin) mirrorStats(w http.ResponseWriter, req *http.Request) {
+	hub := me.hub(w, req)
+	if hub == nil {
+		return
+	}
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	queues := make(map[string]mirrorJSON)
+	for queue, stats := range hub.AllMirrorStats() {
+		n := time.Duration(stats.Requests)
+		queues[queue] = mirrorJSON{
+			Requests:       stats.Requests,
+			StatusDiffs:    stats.StatusDiffs,
+			PrimaryLatency: ms(stats.PrimaryLatency / n),
+			ShadowLatency:  ms(stats.ShadowLatency / n),
+			LatencyDiff:    ms(stats.LatencyDiff()),
+		}
+	}
+	writeJSON(w, map[string]interface{}{"queues": queues})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,55 @@
+package retinaws
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// AffinityKey selects the part of a request that pins it to a
+// backend connection. Requests with the same key go to the same
+// connection while it is alive. The first non-empty source wins
+type AffinityKey struct {
+	Header string
+	Cookie string
+
+	// 1 based index of a URL path segment. 0 = unused
+	Segment int
+}
+
+func (a AffinityKey) key(hr *http.Request) string {
+	if a.Header != "" {
+		if val := hr.Header.Get(a.Header); val != "" {
+			return val
+		}
+	}
+	if a.Cookie != "" {
+		if cookie, err := hr.Cookie(a.Cookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if a.Segment > 0 {
+		segments := strings.Split(strings.Trim(hr.URL.Path, "/"), "/")
+		if a.Segment <= len(segments) {
+			return segments[a.Segment-1]
+		}
+	}
+	return ""
+}
+
+// rendezvous picks the consumer for key using highest random weight
+// hashing, so a consumer joining or leaving only moves its own keys
+func rendezvous(key string, consumers []*consumer) *consumer {
+	var best *consumer
+	var bestWeight uint64
+	for _, c := range consumers {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(c.id))
+		if weight := h.Sum64(); best == nil || weight > bestWeight {
+			best, bestWeight = c, weight
+		}
+	}
+	return best
+}
@@ -1,9 +1,15 @@
 package retinaws
 
 import (
+	"context"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
+	"net/url"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type MessageHandler func(headers map[string][]string, body []byte) (map[string][]string, []byte)
@@ -14,42 +20,119 @@ type internalMessage struct {
 	body    []byte
 }
 
-func BackendServer(wsUrl string, workers int, handler MessageHandler, stop <-chan bool) {
-	dialer := websocket.Dialer{ReadBufferSize: 2048, WriteBufferSize: 2048}
-	ws, _, err := dialer.Dial(wsUrl, nil)
+// Backend connects to a hub and runs Handler for each request
+// received on the queues listed in URL
+type Backend struct {
+	// Hub websocket URL, ending in a comma separated list of queues.
+	// Queues may be glob patterns such as billing.* (escape ? as %3F)
+	URL string
+
+	// Number of worker goroutines kept running. See Pool
+	Workers int
+
+	// Sizing of the worker pool. Zero value keeps Workers running,
+	// adding up to 256 while requests wait
+	Pool PoolConfig
+
+	Handler MessageHandler
+
+	// Heartbeat settings for the hub connection. Zero value uses DefaultHeartbeat
+	Heartbeat Heartbeat
+
+	// Optional version label sent to the hub, used to split traffic
+	// between backend builds serving the same queues
+	Version string
+
+	// Compression of replies sent to the hub
+	Compression Compression
+
+	// Largest request body accepted from the hub. 0 = 4 MiB
+	MaxMessageSize int64
+
+	// calls and streamed replies made by the Handler, see Call and
+	// Stream. Set by Run
+	calls *caller
+
+	lock sync.Mutex
+	pool *workerPool
+
+	// streamed replies in progress, by X-Hub-Id
+	streams map[string]*ReplyStream
+}
+
+// dialURL returns URL with the backend's registration metadata added
+func (b *Backend) dialURL() (string, error) {
+	if b.Version == "" {
+		return b.URL, nil
+	}
+	u, err := url.Parse(b.URL)
 	if err != nil {
-		log.Fatalln("BackendServer: Dial err", wsUrl, err)
+		return "", err
 	}
+	query := u.Query()
+	query.Set("version", b.Version)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func BackendServer(wsUrl string, workers int, handler MessageHandler, stop <-chan bool) {
+	b := &Backend{URL: wsUrl, Workers: workers, Handler: handler}
+	b.Run(stop)
+}
 
-	if workers < 1 {
-		workers = 1
+// Run serves requests until stop receives a value or the hub
+// connection is closed. Exits the process if the hub cannot be reached
+func (b *Backend) Run(stop <-chan bool) {
+	if err := b.Serve(stop); err != nil {
+		log.Fatalln("BackendServer:", err)
 	}
+}
 
+// Serve is like Run, but returns an error if the hub cannot be reached
+func (b *Backend) Serve(stop <-chan bool) error {
+	wsUrl, err := b.dialURL()
+	if err != nil {
+		return fmt.Errorf("invalid URL %s: %v", b.URL, err)
+	}
+	handler := b.Handler
+	dialer := websocket.Dialer{ReadBufferSize: 2048, WriteBufferSize: 2048, Subprotocols: Subprotocols, EnableCompression: b.Compression.Deflate}
+	ws, _, err := dialer.Dial(wsUrl, nil)
+	if err != nil {
+		return fmt.Errorf("dial %s: %v", wsUrl, err)
+	}
 	log.Println("BackendServer: started")
 
 	// messages outbound to retina
 	// we always close this channel
 	toRetina := make(chan *Message)
+	out := frameEncoder{codec: codecFor(ws.Subprotocol()), compression: b.Compression}
+	b.calls = newCaller(out, toRetina)
 
 	// messages inbound from retina
 	fromRetina := make(chan *Message)
 
 	// start pump to send/receive data on websocket
 	conn := NewConnection(ws, toRetina, fromRetina)
+	conn.SetHeartbeat(b.Heartbeat)
+	conn.SetMaxMessageSize(b.MaxMessageSize)
 
-	// internal channel for worker goroutines
-	toWorkers := make(chan *internalMessage)
+	// closed once replies can no longer be sent
+	writerDone := make(chan bool)
 
-	workerWg := &sync.WaitGroup{}
+	pool := newWorkerPool(b.Pool, b.Workers, func(msg *internalMessage) bool {
+		return b.runTask(handler, out, msg, toRetina, writerDone)
+	})
+	b.lock.Lock()
+	b.pool = pool
+	b.lock.Unlock()
 
-	for i := 0; i < workers; i++ {
-		workerWg.Add(1)
-		go backendWorker(handler, workerWg, toWorkers, toRetina)
-	}
+	// set once stop is received, so queued requests are still handled
+	stopping := false
 
 	go conn.readPump()
 	go func() {
 		conn.writePump()
+		close(writerDone)
 		ws.Close()
 		log.Println("BackendServer: websocket closed")
 	}()
@@ -59,66 +142,338 @@ func BackendServer(wsUrl string, workers int, handler MessageHandler, stop <-cha
 		case msg, ok := <-fromRetina:
 			if !ok {
 				log.Println("BackendServer: fromRetina closed, stopping workers")
-				close(toWorkers)
-				workerWg.Wait()
+				b.calls.close()
+				if !stopping {
+					// the hub is gone, so queued requests could get no reply
+					if n := pool.discard(); n > 0 {
+						log.Println("BackendServer: dropped", n, "queued requests")
+					}
+				}
+				pool.close()
 				close(toRetina)
-				return
+				return nil
 			} else if msg.Type == websocket.BinaryMessage {
-				headers, body := ParseFrame(msg.Data)
-				id, ok := headers["X-Hub-Id"]
+				frame, err := readFrame(out.codec, msg.Data, b.MaxMessageSize)
+				if err != nil {
+					log.Println("BackendServer: invalid frame", err)
+					continue
+				}
+				if frame.Op == OpResult {
+					b.calls.result(frame)
+					continue
+				}
+				if frame.Op == OpCredit || frame.Op == OpCancel {
+					b.streamControl(frame)
+					continue
+				}
+				id, ok := frame.Headers["X-Hub-Id"]
 				if !ok {
 					log.Println("BackendServer: worker got request without X-Hub-Id header")
 				} else {
-					toRetina <- reply(ackHeaders, ackBody, id)
-
-					imsg := &internalMessage{id: id, headers: headers, body: body}
 					select {
-					case toWorkers <- imsg:
-						// ok
-					default:
-						workerWg.Add(1)
-						go func() {
-							runTask(handler, imsg, toRetina)
-							workerWg.Done()
-						}()
+					case toRetina <- out.reply(OpAck, nil, ackBody, id):
+					case <-writerDone:
+						continue
+					}
+
+					imsg := &internalMessage{id: id, headers: frame.Headers, body: frame.Body}
+					if !pool.submit(imsg) {
+						log.Println("BackendServer: worker pool full, rejecting", id[0])
+						e := newError(503, CodeOverloaded, "backend worker pool is full")
+						select {
+						case toRetina <- out.reply(OpNone, e.Headers(), nil, id):
+						case <-writerDone:
+						}
 					}
 				}
 			}
 		case <-stop:
 			log.Println("BackendServer: stop received")
 			conn.stopRead()
+			stopping = true
+			// stop may be closed rather than sent to
+			stop = nil
 		}
 	}
+}
+
+// Call sends a request to another queue over the hub connection and
+// waits for the response. parent holds the headers of the request
+// being handled: the call gets the parent's deadline (or ctx's, if
+// earlier) and is added to its call chain. Must be called from Handler
+func (b *Backend) Call(ctx context.Context, parent map[string][]string, req *ClientRequest) (*Response, error) {
+	if b.calls == nil {
+		return nil, ErrClientClosed
+	}
+	deadline := time.Now().Add(defaultClientTimeout)
+	if ms, err := strconv.ParseInt(firstHeader(parent, "X-Hub-Deadline"), 10, 64); err == nil {
+		deadline = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	return b.calls.do(ctx, req, firstHeader(parent, "X-Hub-Call-Chain"))
+}
+
+// ReplyStream sends a reply to the hub in parts. See Backend.Stream
+type ReplyStream struct {
+	calls    *caller
+	id       []string
+	limit    int64
+	deadline time.Time
+
+	// bytes written, including parts rejected for exceeding limit
+	sent int64
+
+	// bytes the hub offers to buffer ahead of the client, 0 if it
+	// does not take part in flow control
+	window int64
 
-	log.Println("BackendServer: exiting")
+	lock sync.Mutex
+	more chan bool
+
+	// bytes that may be sent before the hub returns credit
+	credit int64
+
+	// why the hub aborted the stream
+	err *HubError
 }
 
-func backendWorker(handler MessageHandler, wg *sync.WaitGroup, in chan *internalMessage, toRetina chan *Message) {
-	defer wg.Done()
+var errStreamTimeout = newError(504, CodeTimeout, "streamed reply timed out waiting for the client")
+
+// Stream starts a streamed reply to the request with headers parent,
+// sending the status and reply headers right away. Parts written to
+// the stream are passed on to the client as they arrive, and Write
+// blocks while the client is behind. The Handler ends the stream by
+// returning as usual: the headers it returns are ignored and the body
+// is sent as the last part
+func (b *Backend) Stream(parent map[string][]string, status int, headers map[string][]string) (*ReplyStream, error) {
+	id, ok := parent["X-Hub-Id"]
+	if !ok || b.calls == nil {
+		return nil, ErrClientClosed
+	}
+	reply := make(map[string][]string, len(headers)+2)
+	for name, vals := range headers {
+		reply[name] = vals
+	}
+	reply["X-Hub-Id"] = id
+	reply["X-Hub-Status"] = []string{strconv.Itoa(status)}
+
+	s := &ReplyStream{calls: b.calls, id: id, limit: replyLimit(parent), more: make(chan bool, 1)}
+	if ms, err := strconv.ParseInt(firstHeader(parent, "X-Hub-Deadline"), 10, 64); err == nil {
+		s.deadline = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	// accept the hub's offer of flow control by echoing it
+	if window, err := strconv.ParseInt(firstHeader(parent, "X-Hub-Stream-Window"), 10, 64); err == nil && window > 0 {
+		s.window, s.credit = window, window
+		reply["X-Hub-Stream-Window"] = parent["X-Hub-Stream-Window"]
+	}
+	if err := s.calls.write(context.Background(), &Frame{Op: OpChunk, Headers: reply}); err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	if b.streams == nil {
+		b.streams = make(map[string]*ReplyStream)
+	}
+	b.streams[id[0]] = s
+	b.lock.Unlock()
+	return s, nil
+}
+
+// Write sends p as the next part of the reply, waiting for the hub
+// while the client is more than the hub's window behind. Returns an
+// error once the parts add up to more than the hub's reply size limit,
+// in which case the client gets a 502 response_too_large error instead
+// of the rest of the reply, or if the hub aborted the reply or the
+// request's deadline passed
+func (s *ReplyStream) Write(p []byte) (int, error) {
+	s.sent += int64(len(p))
+	if s.sent > s.limit {
+		return 0, responseTooLarge(int(s.sent), s.limit)
+	}
+	ctx := context.Background()
+	if !s.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, s.deadline)
+		defer cancel()
+	}
+	written := 0
+	for written < len(p) {
+		n, err := s.reserve(ctx, len(p)-written)
+		if err != nil {
+			return written, err
+		}
+		f := &Frame{Op: OpChunk, Headers: map[string][]string{"X-Hub-Id": s.id}, Body: p[written : written+n]}
+		if err := s.calls.write(ctx, f); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(p), nil
+}
+
+// reserve waits for credit to send up to want bytes, returning how many
+// may be sent
+func (s *ReplyStream) reserve(ctx context.Context, want int) (int, error) {
 	for {
-		msg, ok := <-in
-		if !ok {
-			log.Println("BackendServer: worker done")
-			return
+		s.lock.Lock()
+		err, n := s.err, int64(want)
+		if err == nil && s.window > 0 {
+			if n > s.credit {
+				n = s.credit
+			}
+			s.credit -= n
+		}
+		s.lock.Unlock()
+		if err != nil {
+			return 0, err
+		} else if n > 0 {
+			return int(n), nil
 		}
+		select {
+		case <-s.more:
+		case <-s.calls.done:
+			return 0, ErrClientClosed
+		case <-ctx.Done():
+			s.fail(errStreamTimeout)
+			return 0, errStreamTimeout
+		}
+	}
+}
 
-		runTask(handler, msg, toRetina)
+// fail aborts the stream with err unless it already was
+func (s *ReplyStream) fail(err *HubError) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
 	}
+	s.lock.Unlock()
+	s.wake()
 }
 
-func runTask(handler MessageHandler, msg *internalMessage, toRetina chan *Message) {
-	respHeaders, respBody := handler(msg.headers, msg.body)
-	toRetina <- reply(respHeaders, respBody, msg.id)
+func (s *ReplyStream) wake() {
+	select {
+	case s.more <- true:
+	default:
+	}
+}
+
+// streamControl applies a credit or cancel frame from the hub to the
+// streamed reply it names. Frames for ended streams are ignored
+func (b *Backend) streamControl(f *Frame) {
+	b.lock.Lock()
+	s, ok := b.streams[firstHeader(f.Headers, "X-Hub-Id")]
+	b.lock.Unlock()
+	if !ok {
+		return
+	}
+	if f.Op == OpCancel {
+		status, _ := strconv.Atoi(firstHeader(f.Headers, "X-Hub-Status"))
+		if err := backendError(status, f.Headers, nil); err != nil {
+			s.fail(err)
+		} else {
+			s.fail(newError(502, CodeBackendError, "hub cancelled the streamed reply"))
+		}
+		return
+	}
+	credit, err := strconv.ParseInt(firstHeader(f.Headers, "X-Hub-Credit"), 10, 64)
+	if err != nil || credit <= 0 {
+		log.Println("BackendServer: invalid stream credit", firstHeader(f.Headers, "X-Hub-Credit"))
+		return
+	}
+	s.lock.Lock()
+	s.credit += credit
+	s.lock.Unlock()
+	s.wake()
+}
+
+// endStream forgets the streamed reply to id, returning the bytes
+// written to it and why the hub aborted it. 0 if the reply was not
+// streamed
+func (b *Backend) endStream(id string) (int64, *HubError) {
+	b.lock.Lock()
+	s, ok := b.streams[id]
+	delete(b.streams, id)
+	b.lock.Unlock()
+	if !ok {
+		return 0, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sent, s.err
+}
+
+// PoolStats returns the state of the worker pool serving the current
+// hub connection
+func (b *Backend) PoolStats() PoolStats {
+	b.lock.Lock()
+	pool := b.pool
+	b.lock.Unlock()
+	if pool == nil {
+		return PoolStats{}
+	}
+	return pool.snapshot()
+}
+
+// runTask runs handler and sends its reply. A panic in handler is
+// logged and replied to with a 500 error. Returns true if it panicked
+func (b *Backend) runTask(handler MessageHandler, out frameEncoder, msg *internalMessage, toRetina chan *Message, writerDone chan bool) bool {
+	respHeaders, respBody, panicked := callHandler(handler, msg)
+	// the parts of a streamed reply count towards the limit too
+	sent, aborted := b.endStream(msg.id[0])
+	size := sent + int64(len(respBody))
+	if aborted != nil {
+		// end with the error so the hub does not take the reply as whole
+		respHeaders, respBody = aborted.Headers(), nil
+	} else if limit := replyLimit(msg.headers); size > limit {
+		// an oversized message would make the hub drop the connection
+		log.Printf("BackendServer: reply to %s exceeds %d bytes", msg.id[0], limit)
+		respHeaders, respBody = responseTooLarge(int(size), limit).Headers(), nil
+	}
+	select {
+	case toRetina <- out.reply(OpNone, respHeaders, respBody, msg.id):
+	case <-writerDone:
+		log.Println("BackendServer: connection closed, dropping reply to", msg.id[0])
+	}
+	return panicked
+}
+
+func callHandler(handler MessageHandler, msg *internalMessage) (headers map[string][]string, body []byte, panicked bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("BackendServer: handler panic on %s: %v\n%s", msg.id[0], p, debug.Stack())
+			headers, body, panicked = newError(500, CodeInternal, "handler panicked").Headers(), nil, true
+		}
+	}()
+	headers, body = handler(msg.headers, msg.body)
+	return
+}
+
+// replyLimit returns the largest reply body the hub accepts for a request
+func replyLimit(headers map[string][]string) int64 {
+	limit, err := strconv.ParseInt(firstHeader(headers, "X-Hub-Max-Response-Size"), 10, 64)
+	if err != nil || limit <= 0 {
+		return maxMessageSize
+	}
+	return limit
 }
 
-var ackHeaders = map[string][]string{"X-Hub-ControlOp": []string{"ack"}}
 var ackBody = []byte("ack")
 
-func reply(headers map[string][]string, body []byte, id []string) *Message {
+// frameEncoder encodes frames sent to the hub in the negotiated format
+type frameEncoder struct {
+	codec       FrameCodec
+	compression Compression
+}
+
+func (e frameEncoder) encode(f *Frame) *Message {
+	data := e.codec.Encode(e.compression.compress(f, e.codec))
+	return &Message{Type: websocket.BinaryMessage, Data: data}
+}
+
+func (e frameEncoder) reply(op ControlOp, headers map[string][]string, body []byte, id []string) *Message {
 	if headers == nil {
 		headers = make(map[string][]string)
 	}
 	headers["X-Hub-Id"] = id
-	respFrame := WriteFrame(headers, body)
-	return &Message{Type: websocket.BinaryMessage, Data: respFrame}
+	return e.encode(&Frame{Op: op, Headers: headers, Body: body})
 }
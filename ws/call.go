@@ -0,0 +1,124 @@
+package retinaws
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clients connected to the hub (see Client) send requests as OpCall
+// frames with these headers:
+//
+//	X-Hub-Call-Id     chosen by the client, unique on the connection
+//	X-Hub-Queue       queue to send the request to
+//	X-Hub-Method      HTTP method passed to the backend. Default POST
+//	X-Hub-Uri         URI passed to the backend. Default /{queue}
+//	X-Hub-Timeout     milliseconds the client will wait for a response
+//	X-Hub-Call-Chain  chain of the request being handled, for calls
+//	                  made by a backend handler
+//
+// Backends receive each request's chain, ending in its own ID, in
+// X-Hub-Call-Chain along with its X-Hub-Request-Id and X-Hub-Deadline
+// (unix milliseconds), so nested calls can be traced and inherit the
+// deadline. Chains longer than maxCallDepth are rejected to stop loops
+//
+// The response is an OpResult frame with the same X-Hub-Call-Id, an
+// X-Hub-Status and X-Request-Id, plus the X-Hub-Error headers
+// described on HubError if the call failed
+
+const maxCallDepth = 16
+
+// call sends a client request to its queue and returns the result frame
+func (me *External) call(f *Frame, remoteAddr string) *Frame {
+	id := RandHex(8)
+	queue := firstHeader(f.Headers, "X-Hub-Queue")
+	method := firstHeader(f.Headers, "X-Hub-Method")
+	if method == "" {
+		method = "POST"
+	}
+
+	var chain []string
+	if s := firstHeader(f.Headers, "X-Hub-Call-Chain"); s != "" {
+		chain = strings.Split(s, ",")
+	}
+
+	var resp *Response
+	conf := me.Router.Config(queue)
+	if len(chain) >= maxCallDepth {
+		resp = errorResponse(newError(508, CodeCallDepth, "call chain too deep: "+strings.Join(chain, ",")))
+	} else if queue == "" {
+		resp = errorResponse(newError(404, CodeQueueUndefined, "queue is undefined"))
+	} else if !conf.allowsMethod(method) {
+		resp = errorResponse(newError(405, CodeMethodNotAllowed, "method not allowed on queue: "+queue))
+	} else if int64(len(f.Body)) > conf.bodyLimit() {
+		resp = errorResponse(newError(413, CodeBodyTooLarge, "request body too large"))
+	} else if r, err := me.fromCall(id, queue, method, f, remoteAddr, conf); err != nil {
+		resp = errorResponse(newError(400, CodeBadRequest, err.Error()))
+	} else {
+		r.Chain = chain
+		resp = me.dispatch(r, conf)
+		resp.readAll()
+	}
+	return resultFrame(firstHeader(f.Headers, "X-Hub-Call-Id"), id, resp)
+}
+
+// fromCall builds the request for a client call the same way as for
+// an HTTP request, so queue settings such as affinity apply alike
+func (me *External) fromCall(id, queue, method string, f *Frame, remoteAddr string, conf QueueConfig) (*Request, error) {
+	uri := firstHeader(f.Headers, "X-Hub-Uri")
+	if uri == "" {
+		uri = "/" + queue
+	}
+	hr, err := http.NewRequest(method, uri, bytes.NewReader(f.Body))
+	if err != nil {
+		return nil, err
+	}
+	hr.RequestURI = uri
+	hr.RemoteAddr = remoteAddr
+	for name, vals := range f.Headers {
+		for _, val := range vals {
+			hr.Header.Add(name, val)
+		}
+	}
+
+	r, err := me.fromHttpRequest(id, queue, nil, hr, &Route{External: me}, conf)
+	if err != nil {
+		return nil, err
+	}
+	if ms, err := strconv.Atoi(firstHeader(f.Headers, "X-Hub-Timeout")); err == nil && ms > 0 {
+		if deadline := time.Now().Add(millis(ms)); deadline.Before(r.Deadline) {
+			r.Deadline = deadline
+		}
+	}
+	return r, nil
+}
+
+func millis(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+func resultFrame(callID, requestID string, resp *Response) *Frame {
+	headers := make(map[string][]string, len(resp.Headers)+6)
+	for name, vals := range resp.Headers {
+		if !strings.HasPrefix(name, "X-Hub-") {
+			headers[name] = vals
+		}
+	}
+
+	status, body := resp.HTTPStatus, resp.Body
+	if resp.Error != nil {
+		for name, vals := range resp.Error.Headers() {
+			headers[name] = vals
+		}
+		status, body = resp.Error.Status, nil
+	}
+	if status == 0 {
+		status = 200
+	}
+	headers["X-Hub-Status"] = []string{strconv.Itoa(status)}
+	headers["X-Hub-Call-Id"] = []string{callID}
+	headers["X-Request-Id"] = []string{requestID}
+	return &Frame{Op: OpResult, Headers: headers, Body: body}
+}
@@ -0,0 +1,272 @@
+package retinaws
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrClientClosed = errors.New("retinaws: client connection closed")
+
+// Client calls hub queues over a websocket connection, so services
+// can reach each other through the hub's routing and load balancing
+// without going through an HTTP vhost. Calls are multiplexed over
+// the one connection and may be made from many goroutines
+type Client struct {
+	// Hub websocket URL, e.g. ws://localhost:9391/
+	URL string
+
+	// Time a call may take if its context has no deadline. 0 = 30 seconds
+	Timeout time.Duration
+
+	// Heartbeat settings for the hub connection. Zero value uses DefaultHeartbeat
+	Heartbeat Heartbeat
+
+	// Compression of requests sent to the hub
+	Compression Compression
+
+	// Largest response body accepted from the hub. 0 = 4 MiB
+	MaxMessageSize int64
+
+	ws    *websocket.Conn
+	conn  *Connection
+	calls *caller
+}
+
+// ClientRequest is a request sent to a queue with Client.Do
+type ClientRequest struct {
+	Queue string
+
+	// HTTP method and URI passed to the backend. Default POST /{queue}
+	Method string
+	URI    string
+
+	Headers map[string][]string
+	Body    []byte
+}
+
+const defaultClientTimeout = 30 * time.Second
+
+// Dial connects to the hub
+func (c *Client) Dial() error {
+	dialer := websocket.Dialer{
+		ReadBufferSize:    2048,
+		WriteBufferSize:   2048,
+		Subprotocols:      Subprotocols,
+		EnableCompression: c.Compression.Deflate,
+	}
+	ws, _, err := dialer.Dial(c.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	send := make(chan *Message)
+	recv := make(chan *Message)
+	c.ws = ws
+	c.calls = newCaller(frameEncoder{codec: codecFor(ws.Subprotocol()), compression: c.Compression}, send)
+	c.conn = NewConnection(ws, send, recv)
+	c.conn.SetHeartbeat(c.Heartbeat)
+	c.conn.SetMaxMessageSize(c.MaxMessageSize)
+
+	go c.conn.readPump()
+	go c.conn.writePump()
+	go c.readResults(recv)
+	return nil
+}
+
+// Close closes the connection. Calls in progress fail with ErrClientClosed
+func (c *Client) Close() {
+	if c.conn == nil {
+		// never connected
+		return
+	}
+	c.conn.close()
+	<-c.calls.done
+}
+
+// Call sends body to queue with the default method and URI
+func (c *Client) Call(ctx context.Context, queue string, body []byte) (*Response, error) {
+	return c.Do(ctx, &ClientRequest{Queue: queue, Body: body})
+}
+
+// Do sends a request and waits for its response, the context to be
+// done or the connection to close. Hub and backend errors are
+// returned as a *HubError along with the response
+func (c *Client) Do(ctx context.Context, req *ClientRequest) (*Response, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = defaultClientTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if c.calls == nil {
+		return nil, ErrClientClosed
+	}
+	return c.calls.do(ctx, req, "")
+}
+
+// readResults hands results to the waiting calls until the connection closes
+func (c *Client) readResults(recv chan *Message) {
+	defer func() {
+		c.calls.close()
+		// stops writePump at its next ping
+		c.ws.Close()
+	}()
+
+	for msg := range recv {
+		if msg.Type != websocket.BinaryMessage {
+			continue
+		}
+		f, err := readFrame(c.calls.out.codec, msg.Data, c.MaxMessageSize)
+		if err != nil {
+			log.Println("retinaws: client got invalid frame:", err)
+			continue
+		}
+		if f.Op == OpResult {
+			c.calls.result(f)
+		}
+	}
+}
+
+// caller tracks the calls made over a hub connection
+type caller struct {
+	out  frameEncoder
+	send chan<- *Message
+
+	// closed once the connection is gone
+	done chan bool
+
+	lock    sync.Mutex
+	count   int
+	pending map[string]chan *Response
+}
+
+func newCaller(out frameEncoder, send chan<- *Message) *caller {
+	return &caller{
+		out:     out,
+		send:    send,
+		done:    make(chan bool),
+		pending: make(map[string]chan *Response),
+	}
+}
+
+// do sends a call and waits for its result. ctx must have a deadline,
+// which is passed on to the hub. chain is the X-Hub-Call-Chain of the
+// request the call is made for, if any
+func (c *caller) do(ctx context.Context, req *ClientRequest, chain string) (*Response, error) {
+	id, replyTo := c.register()
+	if replyTo == nil {
+		return nil, ErrClientClosed
+	}
+	defer c.unregister(id)
+
+	headers := make(map[string][]string, len(req.Headers)+6)
+	for name, vals := range req.Headers {
+		headers[name] = vals
+	}
+	headers["X-Hub-Call-Id"] = []string{id}
+	headers["X-Hub-Queue"] = []string{req.Queue}
+	if req.Method != "" {
+		headers["X-Hub-Method"] = []string{req.Method}
+	}
+	if req.URI != "" {
+		headers["X-Hub-Uri"] = []string{req.URI}
+	}
+	if chain != "" {
+		headers["X-Hub-Call-Chain"] = []string{chain}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := time.Until(deadline) / time.Millisecond
+		headers["X-Hub-Timeout"] = []string{strconv.Itoa(int(ms) + 1)}
+	}
+
+	if err := c.write(ctx, &Frame{Op: OpCall, Headers: headers, Body: req.Body}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-replyTo:
+		if resp.Error != nil {
+			return resp, resp.Error
+		}
+		return resp, nil
+	case <-c.done:
+		return nil, ErrClientClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// write sends a frame unless the connection is closed or ctx is done first
+func (c *caller) write(ctx context.Context, f *Frame) error {
+	select {
+	case c.send <- c.out.encode(f):
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// register allocates a call id. Returns a nil channel once closed
+func (c *caller) register() (string, chan *Response) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pending == nil {
+		return "", nil
+	}
+	c.count++
+	id := strconv.Itoa(c.count)
+	replyTo := make(chan *Response, 1)
+	c.pending[id] = replyTo
+	return id, replyTo
+}
+
+func (c *caller) unregister(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, id)
+}
+
+// result hands a result frame to the call waiting for it
+func (c *caller) result(f *Frame) {
+	id := firstHeader(f.Headers, "X-Hub-Call-Id")
+	c.lock.Lock()
+	replyTo := c.pending[id]
+	delete(c.pending, id)
+	c.lock.Unlock()
+	if replyTo != nil {
+		replyTo <- responseOf(f)
+	}
+}
+
+// close fails the calls in progress and any made later
+func (c *caller) close() {
+	c.lock.Lock()
+	c.pending = nil
+	c.lock.Unlock()
+	close(c.done)
+}
+
+// responseOf converts a result frame to a Response
+func responseOf(f *Frame) *Response {
+	status, _ := strconv.Atoi(firstHeader(f.Headers, "X-Hub-Status"))
+	resp := &Response{
+		HTTPStatus: status,
+		Headers:    f.Headers,
+		Body:       f.Body,
+		Error:      backendError(status, f.Headers, f.Body),
+	}
+	if resp.Error != nil {
+		resp.Error.RequestID = firstHeader(f.Headers, "X-Request-Id")
+	}
+	return resp
+}
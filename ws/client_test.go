@@ -0,0 +1,20 @@
+package retinaws
+
+import (
+	"context"
+	. "launchpad.net/gocheck"
+)
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) TestCloseWithoutConnection(c *C) {
+	client := &Client{URL: "ws://127.0.0.1:1/"}
+	c.Check(client.Dial(), NotNil)
+	client.Close()
+
+	_, err := client.Call(context.Background(), "queue", nil)
+	c.Check(err, Equals, ErrClientClosed)
+	(&Client{}).Close()
+}
@@ -0,0 +1,143 @@
+package retinaws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression controls how traffic on a hub connection is compressed
+type Compression struct {
+	// Negotiate permessage-deflate for the websocket connection
+	Deflate bool
+
+	// Encoding applied to frame bodies of at least MinSize bytes, such
+	// as "gzip". Other encodings (e.g. zstd) can be added with
+	// RegisterEncoding. Empty = bodies are sent as is
+	Encoding string
+	MinSize  int
+}
+
+// BodyEncoding compresses and decompresses frame bodies. Decompress
+// fails rather than return more than limit bytes
+type BodyEncoding interface {
+	Compress(body []byte) ([]byte, error)
+	Decompress(body []byte, limit int64) ([]byte, error)
+}
+
+// Frame header naming the encoding of a compressed body. Only sent
+// on v2 connections, as older peers would pass the body on as is
+const encodingHeader = "X-Hub-Content-Encoding"
+
+var errBodyTooLarge = errors.New("retinaws: decompressed body too large")
+
+var (
+	encodingsLock sync.RWMutex
+	encodings     = map[string]BodyEncoding{"gzip": gzipEncoding{}}
+)
+
+// RegisterEncoding makes a body encoding available to hubs and
+// backends under name. Both peers must register it
+func RegisterEncoding(name string, e BodyEncoding) {
+	encodingsLock.Lock()
+	encodings[name] = e
+	encodingsLock.Unlock()
+}
+
+func encodingFor(name string) BodyEncoding {
+	encodingsLock.RLock()
+	defer encodingsLock.RUnlock()
+	return encodings[name]
+}
+
+// compress encodes the frame body if it is large enough and the
+// encoding makes it smaller. The frame headers are copied, not modified
+func (c Compression) compress(f *Frame, codec FrameCodec) *Frame {
+	if c.Encoding == "" || len(f.Body) < c.MinSize || codec != FrameV2 {
+		return f
+	}
+	e := encodingFor(c.Encoding)
+	if e == nil {
+		return f
+	}
+	body, err := e.Compress(f.Body)
+	if err != nil || len(body) >= len(f.Body) {
+		return f
+	}
+
+	headers := make(map[string][]string, len(f.Headers)+1)
+	for k, v := range f.Headers {
+		headers[k] = v
+	}
+	headers[encodingHeader] = []string{c.Encoding}
+	return &Frame{Op: f.Op, Headers: headers, Body: body}
+}
+
+// decompress restores the body of a frame sent with compress. Bodies
+// that expand to more than limit bytes are rejected
+func decompress(f *Frame, limit int64) error {
+	names, ok := f.Headers[encodingHeader]
+	if !ok || len(names) < 1 {
+		return nil
+	}
+	e := encodingFor(names[0])
+	if e == nil {
+		return fmt.Errorf("retinaws: unknown body encoding: %s", names[0])
+	}
+	body, err := e.Decompress(f.Body, limit)
+	if err != nil {
+		return err
+	}
+	f.Body = body
+	delete(f.Headers, encodingHeader)
+	return nil
+}
+
+// readFrame decodes a websocket message, decompressing its body up to
+// the connection's body size limit maxBody. 0 = maxMessageSize
+func readFrame(codec FrameCodec, data []byte, maxBody int64) (*Frame, error) {
+	f, err := codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if maxBody <= 0 {
+		maxBody = maxMessageSize
+	}
+	if err := decompress(f, maxBody); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type gzipEncoding struct{}
+
+func (gzipEncoding) Compress(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipEncoding) Decompress(body []byte, limit int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,26 @@
+package retinaws
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type CompressSuite struct{}
+
+var _ = Suite(&CompressSuite{})
+
+func (s *CompressSuite) TestDecompressLimitedToBodySize(c *C) {
+	// 1 MiB of zeros gzips to about a KB
+	body := make([]byte, 1<<20)
+	f := Compression{Encoding: "gzip"}.compress(&Frame{Headers: map[string][]string{}, Body: body}, FrameV2)
+	c.Assert(f.Headers[encodingHeader], DeepEquals, []string{"gzip"})
+	c.Assert(len(f.Body) < 8<<10, Equals, true)
+	data := FrameV2.Encode(f)
+
+	_, err := readFrame(FrameV2, data, 64<<10)
+	c.Check(err, Equals, errBodyTooLarge)
+
+	out, err := readFrame(FrameV2, data, 1<<20)
+	c.Assert(err, IsNil)
+	c.Check(out.Body, HasLen, 1<<20)
+	c.Check(out.Headers[encodingHeader], IsNil)
+}
@@ -18,16 +18,86 @@ const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 2 * time.Second
+	// Default maximum body size of a message from peer.
+	maxMessageSize = 4096 * 1024
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 4) / 10
+	// Room left for frame headers on top of the body size limit
+	maxHeaderBytes = 64 * 1024
+)
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 4096 * 1024
+// readLimit returns the websocket read limit for messages with
+// bodies of up to maxBody bytes. 0 = maxMessageSize
+func readLimit(maxBody int64) int64 {
+	if maxBody <= 0 {
+		maxBody = maxMessageSize
+	}
+	return maxBody + maxHeaderBytes
+}
+
+// Heartbeat controls how often a connection pings its peer and how
+// long it waits to hear back before giving up on it
+type Heartbeat struct {
+	// Send pings to peer with this period. Must be less than Timeout.
+	Interval time.Duration
+
+	// Time allowed to read the next pong or message from the peer.
+	// The connection is closed once this passes
+	Timeout time.Duration
+}
+
+var DefaultHeartbeat = Heartbeat{
+	Interval: 800 * time.Millisecond,
+	Timeout:  2 * time.Second,
+}
+
+// withDefaults fills in unset fields. A Timeout of 0 becomes
+// 2.5 heartbeat intervals
+func (h Heartbeat) withDefaults() Heartbeat {
+	if h.Interval <= 0 && h.Timeout <= 0 {
+		return DefaultHeartbeat
+	}
+	if h.Interval <= 0 {
+		h.Interval = (h.Timeout * 4) / 10
+	}
+	if h.Timeout <= h.Interval {
+		h.Timeout = (h.Interval * 10) / 4
+	}
+	return h
+}
+
+// suspectAfter is how long the peer may be silent before the
+// connection is considered suspect - one missed heartbeat
+func (h Heartbeat) suspectAfter() time.Duration {
+	after := (h.Interval * 3) / 2
+	if after > h.Timeout {
+		after = h.Timeout
+	}
+	return after
+}
+
+type Liveness int
+
+const (
+	// Peer answered the last heartbeat
+	Healthy Liveness = iota
+
+	// Peer missed a heartbeat. No new requests are dispatched to it
+	Suspect
+
+	// Peer missed heartbeats until Timeout or the connection closed
+	Dead
 )
 
+func (l Liveness) String() string {
+	switch l {
+	case Healthy:
+		return "healthy"
+	case Suspect:
+		return "suspect"
+	}
+	return "dead"
+}
+
 type Message struct {
 	Type int
 	Data []byte
@@ -35,11 +105,14 @@ type Message struct {
 
 func NewConnection(ws *websocket.Conn, send, recv chan *Message) *Connection {
 	return &Connection{
-		ws:   ws,
-		send: send,
-		recv: recv,
-		stop: false,
-		lock: &sync.Mutex{},
+		ws:        ws,
+		send:      send,
+		recv:      recv,
+		stop:      false,
+		lock:      &sync.Mutex{},
+		readLimit: readLimit(0),
+		heartbeat: DefaultHeartbeat,
+		lastSeen:  time.Now(),
 	}
 }
 
@@ -64,6 +137,53 @@ type Connection struct {
 
 	lock *sync.Mutex
 	stop bool
+
+	readLimit int64
+	heartbeat Heartbeat
+	lastSeen  time.Time
+	closed    bool
+}
+
+// SetHeartbeat changes the heartbeat settings. Must be called
+// before the pumps are started
+func (c *Connection) SetHeartbeat(h Heartbeat) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.heartbeat = h.withDefaults()
+}
+
+// SetMaxMessageSize changes the largest message body accepted from
+// the peer. Must be called before readPump is started
+func (c *Connection) SetMaxMessageSize(n int64) {
+	c.readLimit = readLimit(n)
+}
+
+// Liveness reports whether the peer is keeping up with heartbeats
+func (c *Connection) Liveness() Liveness {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return Dead
+	}
+	silent := time.Since(c.lastSeen)
+	if silent >= c.heartbeat.Timeout {
+		return Dead
+	} else if silent >= c.heartbeat.suspectAfter() {
+		return Suspect
+	}
+	return Healthy
+}
+
+// seen records that the peer is alive and pushes back the read deadline
+func (c *Connection) seen() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.stop {
+		c.lastSeen = time.Now()
+		c.ws.SetReadDeadline(c.lastSeen.Add(c.heartbeat.Timeout))
+	}
 }
 
 func (c *Connection) stopRead() {
@@ -73,6 +193,12 @@ func (c *Connection) stopRead() {
 	c.stop = true
 }
 
+// close stops readPump right away instead of at the next read deadline
+func (c *Connection) close() {
+	c.stopRead()
+	c.ws.SetReadDeadline(time.Now())
+}
+
 func (c *Connection) reading() bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -81,14 +207,17 @@ func (c *Connection) reading() bool {
 
 // readPump pumps messages from the websocket connection to the hub.
 func (c *Connection) readPump() {
-	defer close(c.recv)
+	defer func() {
+		c.lock.Lock()
+		c.closed = true
+		c.lock.Unlock()
+		close(c.recv)
+	}()
 
-	c.ws.SetReadLimit(maxMessageSize)
-	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetReadLimit(c.readLimit)
+	c.seen()
 	c.ws.SetPongHandler(func(string) error {
-		if c.reading() {
-			c.ws.SetReadDeadline(time.Now().Add(pongWait))
-		}
+		c.seen()
 		return nil
 	})
 	for c.reading() {
@@ -101,6 +230,7 @@ func (c *Connection) readPump() {
 			}
 			break
 		} else {
+			c.seen()
 			c.recv <- &Message{Type: messageType, Data: data}
 		}
 	}
@@ -114,7 +244,9 @@ func (c *Connection) write(mt int, payload []byte) error {
 
 // writePump pumps messages from the hub to the websocket connection.
 func (c *Connection) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	c.lock.Lock()
+	ticker := time.NewTicker(c.heartbeat.Interval)
+	c.lock.Unlock()
 	defer func() {
 		ticker.Stop()
 		c.stopRead()
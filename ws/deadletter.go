@@ -0,0 +1,218 @@
+package retinaws
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DeadLetterStore keeps, per queue, the requests on dead-lettering
+// queues whose retries ran out, so they can be inspected, replayed
+// or purged. The zero value keeps them in memory only
+type DeadLetterStore struct {
+	// Most requests kept per queue. The oldest are dropped. 0 = 1000
+	MaxPerQueue int
+
+	// log the requests are kept in, if opened on disk
+	store *DurableStore
+
+	lock   sync.Mutex
+	queues map[string][]*DurableEntry
+}
+
+const defaultMaxDeadLetters = 1000
+
+// OpenDeadLetterStore returns a store that keeps its requests in
+// logs in dir, loading those left by an earlier run
+func OpenDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	store, err := OpenDurableStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	d := &DeadLetterStore{store: store, queues: make(map[string][]*DurableEntry)}
+	for _, queue := range store.Queues() {
+		if entries := store.Pending(queue); len(entries) > 0 {
+			d.queues[queue] = entries
+		}
+	}
+	return d, nil
+}
+
+// Close closes the logs of a store opened on disk
+func (d *DeadLetterStore) Close() {
+	if d.store != nil {
+		d.store.Close()
+	}
+}
+
+// Counts returns the number of requests kept per queue
+func (d *DeadLetterStore) Counts() map[string]int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	counts := make(map[string]int, len(d.queues))
+	for queue, entries := range d.queues {
+		counts[queue] = len(entries)
+	}
+	return counts
+}
+
+// List returns the requests kept for queue, oldest first
+func (d *DeadLetterStore) List(queue string) []*DurableEntry {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]*DurableEntry(nil), d.queues[queue]...)
+}
+
+// Purge drops the requests on queue with the given IDs, or all of
+// them if none are given. Returns the number dropped
+func (d *DeadLetterStore) Purge(queue string, ids ...string) int {
+	return len(d.take(queue, ids))
+}
+
+func (d *DeadLetterStore) maxPerQueue() int {
+	if d.MaxPerQueue > 0 {
+		return d.MaxPerQueue
+	}
+	return defaultMaxDeadLetters
+}
+
+// add keeps e, replacing an earlier failure of the same request
+func (d *DeadLetterStore) add(e *DurableEntry) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.queues == nil {
+		d.queues = make(map[string][]*DurableEntry)
+	}
+
+	entries := d.remove(e.Queue, []string{e.ID})
+	if d.store != nil {
+		if err := d.store.add(e); err != nil {
+			log.Println("retinaws: cannot log dead letter on queue:", e.Queue, "-", err)
+		}
+	}
+	entries = append(entries, e)
+	for len(entries) > d.maxPerQueue() {
+		log.Println("retinaws: dropping oldest dead letter on queue:", e.Queue, "-", entries[0].ID)
+		d.forget(entries[0])
+		entries = entries[1:]
+	}
+	d.queues[e.Queue] = entries
+}
+
+// take removes and returns the requests on queue with the given IDs,
+// or all of them if none are given
+func (d *DeadLetterStore) take(queue string, ids []string) []*DurableEntry {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	all := d.queues[queue]
+	if len(ids) == 0 {
+		delete(d.queues, queue)
+		for _, e := range all {
+			d.forget(e)
+		}
+		return all
+	}
+
+	taken := make([]*DurableEntry, 0, len(ids))
+	for _, e := range all {
+		for _, id := range ids {
+			if e.ID == id {
+				taken = append(taken, e)
+				break
+			}
+		}
+	}
+	if kept := d.remove(queue, ids); len(kept) > 0 {
+		d.queues[queue] = kept
+	} else {
+		delete(d.queues, queue)
+	}
+	return taken
+}
+
+// remove forgets the requests on queue with the given IDs and returns
+// the rest. Must be called with lock held
+func (d *DeadLetterStore) remove(queue string, ids []string) []*DurableEntry {
+	kept := make([]*DurableEntry, 0, len(d.queues[queue]))
+	for _, e := range d.queues[queue] {
+		found := false
+		for _, id := range ids {
+			if e.ID == id {
+				found = true
+				break
+			}
+		}
+		if found {
+			d.forget(e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// forget removes e from the log. Must be called with lock held
+func (d *DeadLetterStore) forget(e *DurableEntry) {
+	if d.store == nil {
+		return
+	}
+	if err := d.store.done(e.Queue, e.ID); err != nil {
+		log.Println("retinaws: cannot remove dead letter on queue:", e.Queue, "-", err)
+	}
+}
+
+// deadLetter keeps a request whose retries ran out, if its queue has
+// dead-lettering on
+func (me *External) deadLetter(e *DurableEntry, conf QueueConfig, resp *Response, attempts int) {
+	if !conf.DeadLetter || me.DeadLetters == nil {
+		return
+	}
+	dead := *e
+	dead.Attempts = attempts
+	dead.Status = resp.HTTPStatus
+	dead.Failed = time.Now()
+	if resp.Error != nil {
+		dead.Error = resp.Error.Error()
+	} else {
+		dead.Error = string(truncate(resp.Body, 1024))
+	}
+	log.Println("retinaws: dead-lettering request on queue:", e.Queue, "-", e.ID, resp.HTTPStatus)
+	me.DeadLetters.add(&dead)
+}
+
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
+
+// ReplayDeadLetters sends the dead letters on queue with the given
+// IDs, or all of them, back to the queue in the background. Those
+// the queue does not accept, e.g. as it has no backend, are kept.
+// Returns the number sent and kept
+func (me *External) ReplayDeadLetters(queue string, ids ...string) (replayed, kept int) {
+	if me.DeadLetters == nil {
+		return 0, 0
+	}
+	conf := me.Router.Config(queue)
+	for _, e := range me.DeadLetters.take(queue, ids) {
+		replay := *e
+		replay.Attempts, replay.Status, replay.Error, replay.Failed = 0, 0, "", time.Time{}
+		req := replay.request(time.Now().Add(me.timeout(conf)))
+
+		var resp *Response
+		if conf.Durable && me.Durable != nil {
+			resp = me.sendDurable(req, conf, func(*Response) {})
+		} else {
+			resp = me.sendAsync(req, conf, func(*Response) {})
+		}
+		if resp.HTTPStatus == 202 {
+			replayed++
+		} else {
+			me.DeadLetters.add(e)
+			kept++
+		}
+	}
+	return replayed, kept
+}
@@ -0,0 +1,76 @@
+package retinaws
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DeadLetterSuite struct{}
+
+var _ = Suite(&DeadLetterSuite{})
+
+func (s *DeadLetterSuite) TestReplaySyncDeadLetter(c *C) {
+	internal := &Internal{Router: NewRouter()}
+	internal.Router.Configure("flaky", QueueConfig{DeadLetter: true, Retry: RetryPolicy{Retries: 1, Backoff: time.Millisecond}})
+	url, stop := startHub(internal)
+	defer stop()
+
+	var lock sync.Mutex
+	failing := true
+	replayed := make(chan map[string][]string, 1)
+	b := &Backend{
+		URL:     url + "flaky",
+		Workers: 2,
+		Handler: func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			lock.Lock()
+			defer lock.Unlock()
+			if failing {
+				return newError(500, CodeInternal, "down").Headers(), nil
+			}
+			replayed <- headers
+			return nil, nil
+		},
+	}
+	done := make(chan bool)
+	defer close(done)
+	go b.Serve(done)
+	time.Sleep(100 * time.Millisecond)
+
+	external := &External{Router: internal.Router, Timeout: 2 * time.Second, DeadLetters: &DeadLetterStore{}}
+	route := &Route{External: external, Queue: "flaky"}
+	req := httptest.NewRequest("POST", "/flaky", strings.NewReader("job"))
+	req.Header.Set("X-Tenant", "acme")
+	w := httptest.NewRecorder()
+	route.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, 500)
+
+	// the request is kept as the client sent it, without the headers
+	// the hub added to each attempt
+	dead := external.DeadLetters.List("flaky")
+	c.Assert(dead, HasLen, 1)
+	c.Check(dead[0].Attempts, Equals, 2)
+	for _, name := range []string{"X-Hub-Id", "X-Hub-Queue", "X-Hub-Deadline", "X-Hub-Call-Chain"} {
+		_, ok := dead[0].Headers[name]
+		c.Check(ok, Equals, false, Commentf("%s kept", name))
+	}
+	c.Check(firstHeader(dead[0].Headers, "X-Tenant"), Equals, "acme")
+
+	// and replays like a new request
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	replayedN, kept := external.ReplayDeadLetters("flaky")
+	c.Check(replayedN, Equals, 1)
+	c.Check(kept, Equals, 0)
+	select {
+	case headers := <-replayed:
+		c.Check(firstHeader(headers, "X-Tenant"), Equals, "acme")
+		c.Check(headers["X-Hub-Call-Chain"], DeepEquals, []string{dead[0].ID})
+	case <-time.After(2 * time.Second):
+		c.Fatal("dead letter not replayed")
+	}
+	c.Check(external.DeadLetters.List("flaky"), HasLen, 0)
+}
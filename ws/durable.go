@@ -0,0 +1,577 @@
+package retinaws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DurableStore keeps the requests accepted on durable async queues
+// in a write-ahead log per queue, so they survive a hub restart.
+// A request is logged before the client gets its 202 and marked done
+// once a backend has handled it, so each is delivered at least once.
+// Logs are compacted once CompactAfter requests in them are done
+type DurableStore struct {
+	Dir string
+
+	// Done requests a log may hold before it is rewritten with only
+	// the pending ones. 0 = 1000
+	CompactAfter int
+
+	lock sync.Mutex
+	logs map[string]*wal
+}
+
+const (
+	walSuffix           = ".wal"
+	defaultCompactAfter = 1000
+)
+
+// DurableEntry is a request kept in a durable queue's log
+type DurableEntry struct {
+	ID          string
+	Queue       string
+	Priority    int
+	AffinityKey string
+	Version     string
+	HTTPMethod  string
+	HTTPURI     string
+	Headers     map[string][]string
+	Body        []byte
+
+	MaxResponseSize int64
+
+	// When the request was accepted
+	Accepted time.Time
+
+	// Set on dead letters, see DeadLetterStore: when and how the last
+	// attempt failed and the number of attempts made
+	Failed   time.Time `json:",omitempty"`
+	Status   int       `json:",omitempty"`
+	Error    string    `json:",omitempty"`
+	Attempts int       `json:",omitempty"`
+
+	// order in the log
+	seq uint64
+}
+
+// entryOf returns the log entry for req. Headers are copied in both
+// directions, as the hub adds its own to each request sent while the
+// log may be encoding the entry
+func entryOf(req *Request) *DurableEntry {
+	return &DurableEntry{
+		ID:              req.ID,
+		Queue:           req.Queue,
+		Priority:        req.Priority,
+		AffinityKey:     req.AffinityKey,
+		Version:         req.Version,
+		HTTPMethod:      req.HTTPMethod,
+		HTTPURI:         req.HTTPURI,
+		Headers:         copyHeaders(req.Headers),
+		Body:            req.Body,
+		MaxResponseSize: req.MaxResponseSize,
+		Accepted:        time.Now(),
+	}
+}
+
+// request returns a Request to deliver the entry by deadline
+func (e *DurableEntry) request(deadline time.Time) *Request {
+	return &Request{
+		ID:              e.ID,
+		Queue:           e.Queue,
+		Priority:        e.Priority,
+		AffinityKey:     e.AffinityKey,
+		Version:         e.Version,
+		HTTPMethod:      e.HTTPMethod,
+		HTTPURI:         e.HTTPURI,
+		Headers:         copyHeaders(e.Headers),
+		Body:            e.Body,
+		MaxResponseSize: e.MaxResponseSize,
+		Ack:             make(chan bool, 1),
+		ReplyTo:         make(chan *Response, 1),
+		Deadline:        deadline,
+	}
+}
+
+// OpenDurableStore opens the logs in dir, creating it if needed, and
+// loads the requests still pending in them
+func OpenDurableStore(dir string) (*DurableStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DurableStore{Dir: dir, logs: make(map[string]*wal)}
+	for _, name := range names {
+		queue, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(name), walSuffix))
+		if err != nil {
+			continue
+		}
+		w, err := openWAL(name)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.logs[queue] = w
+	}
+	return s, nil
+}
+
+// Close closes the logs. Pending requests are delivered when the
+// store is next opened
+func (s *DurableStore) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, w := range s.logs {
+		w.close()
+	}
+	s.logs = nil
+}
+
+// Pending returns the requests not yet done on queue, oldest first
+func (s *DurableStore) Pending(queue string) []*DurableEntry {
+	s.lock.Lock()
+	w := s.logs[queue]
+	s.lock.Unlock()
+	if w == nil {
+		return nil
+	}
+	return w.entries()
+}
+
+// Queues returns the queues with logs, sorted
+func (s *DurableStore) Queues() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queues := make([]string, 0, len(s.logs))
+	for queue := range s.logs {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+func (s *DurableStore) log(queue string) (*wal, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.logs == nil {
+		return nil, errors.New("retinaws: durable store is closed")
+	}
+	w, ok := s.logs[queue]
+	if !ok {
+		var err error
+		w, err = openWAL(filepath.Join(s.Dir, url.PathEscape(queue)+walSuffix))
+		if err != nil {
+			return nil, err
+		}
+		s.logs[queue] = w
+	}
+	return w, nil
+}
+
+// add logs e, returning once it is on disk
+func (s *DurableStore) add(e *DurableEntry) error {
+	w, err := s.log(e.Queue)
+	if err != nil {
+		return err
+	}
+	return w.add(e)
+}
+
+// done records that the request id on queue was handled
+func (s *DurableStore) done(queue, id string) error {
+	w, err := s.log(queue)
+	if err != nil {
+		return err
+	}
+	compactAfter := s.CompactAfter
+	if compactAfter < 1 {
+		compactAfter = defaultCompactAfter
+	}
+	return w.done(id, compactAfter)
+}
+
+// walRecord is one entry in a log. Records are written as a 4 byte
+// length and 4 byte CRC-32 of the JSON encoded record, then the record
+type walRecord struct {
+	Add  *DurableEntry `json:",omitempty"`
+	Done string        `json:",omitempty"`
+}
+
+// wal is the log of one queue
+type wal struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	pending map[string]*DurableEntry
+	seq     uint64
+
+	// done records in the file
+	doneCount int
+}
+
+// openWAL replays the log at path. A partly written last record,
+// left by a crash, is truncated
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{path: path, file: file, pending: make(map[string]*DurableEntry)}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		rec, n, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Println("retinaws: truncating damaged log", path, "at", offset, "-", err)
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		offset += n
+		w.apply(rec)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wal) apply(rec *walRecord) {
+	if rec.Add != nil {
+		w.seq++
+		rec.Add.seq = w.seq
+		w.pending[rec.Add.ID] = rec.Add
+	} else if rec.Done != "" {
+		delete(w.pending, rec.Done)
+		w.doneCount++
+	}
+}
+
+func readRecord(r io.Reader) (*walRecord, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("short record header")
+		}
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > uint32(16*maxMessageSize) {
+		return nil, 0, errors.New("record too large")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, errors.New("short record")
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("bad checksum")
+	}
+	rec := &walRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, 0, err
+	}
+	return rec, int64(8 + size), nil
+}
+
+func encodeRecord(rec *walRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[8:], data)
+	return buf, nil
+}
+
+// write appends rec and syncs it to disk. Must be called with lock held
+func (w *wal) write(rec *walRecord) error {
+	if w.file == nil {
+		return errors.New("retinaws: log is closed: " + w.path)
+	}
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	offset, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = w.file.Write(data); err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// drop a partial record so later ones can be replayed
+		w.file.Truncate(offset)
+		w.file.Seek(offset, io.SeekStart)
+	}
+	return err
+}
+
+func (w *wal) add(e *DurableEntry) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	rec := &walRecord{Add: e}
+	if err := w.write(rec); err != nil {
+		return err
+	}
+	w.apply(rec)
+	return nil
+}
+
+func (w *wal) done(id string, compactAfter int) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.pending[id]; !ok {
+		return nil
+	}
+	rec := &walRecord{Done: id}
+	if err := w.write(rec); err != nil {
+		return err
+	}
+	w.apply(rec)
+	if w.doneCount >= compactAfter {
+		return w.compact()
+	}
+	return nil
+}
+
+// entries returns the pending entries in log order. Must not be
+// called with lock held
+func (w *wal) entries() []*DurableEntry {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.sorted()
+}
+
+func (w *wal) sorted() []*DurableEntry {
+	entries := make([]*DurableEntry, 0, len(w.pending))
+	for _, e := range w.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
+
+// compact rewrites the log with only the pending entries. The new log
+// replaces the old one atomically, so a crash leaves one or the other.
+// Must be called with lock held
+func (w *wal) compact() error {
+	tmpPath := w.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(tmp)
+	for _, e := range w.sorted() {
+		data, err := encodeRecord(&walRecord{Add: e})
+		if err == nil {
+			_, err = buf.Write(data)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	// make the rename durable too
+	if dir, err := os.Open(filepath.Dir(w.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	w.file.Close()
+	w.file = tmp
+	w.doneCount = 0
+	return nil
+}
+
+func (w *wal) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// sendDurable logs the request and delivers it in the background
+func (me *External) sendDurable(req *Request, conf QueueConfig, done func(*Response)) *Response {
+	e := entryOf(req)
+	if err := me.Durable.add(e); err != nil {
+		log.Println("retinaws: cannot log request for queue:", req.Queue, "-", err)
+		resp := errorResponse(newError(500, CodeInternal, "cannot store request"))
+		done(resp)
+		return resp
+	}
+	me.queueDurable(durableJob{e, conf, done})
+	return acceptedResponse(req)
+}
+
+// Durable requests delivered at once, see External.DurableWorkers
+const defaultDurableWorkers = 256
+
+// durableJob is a logged request waiting to be delivered
+type durableJob struct {
+	e    *DurableEntry
+	conf QueueConfig
+	done func(*Response)
+}
+
+// queueDurable delivers the jobs on at most DurableWorkers goroutines.
+// Jobs beyond that wait in order; their requests are in memory anyway
+// as pending log entries
+func (me *External) queueDurable(jobs ...durableJob) {
+	limit := me.DurableWorkers
+	if limit < 1 {
+		limit = defaultDurableWorkers
+	}
+	me.durableLock.Lock()
+	defer me.durableLock.Unlock()
+	me.durableJobs = append(me.durableJobs, jobs...)
+	for me.durableRunning < limit && me.durableRunning < len(me.durableJobs) {
+		me.durableRunning++
+		go me.durableWorker()
+	}
+}
+
+// durableWorker delivers queued durable requests until none are left
+func (me *External) durableWorker() {
+	for {
+		me.durableLock.Lock()
+		if len(me.durableJobs) == 0 {
+			me.durableRunning--
+			me.durableLock.Unlock()
+			return
+		}
+		job := me.durableJobs[0]
+		me.durableJobs[0] = durableJob{}
+		me.durableJobs = me.durableJobs[1:]
+		me.durableLock.Unlock()
+
+		me.deliverDurable(job.e, job.conf, job.done)
+	}
+}
+
+// deliverDurable sends e until a backend handles it or its retries
+// run out, then marks it done, dead-lettering it in the latter case.
+// Requests shed by the router, e.g. as no backend is connected, are
+// retried without limit, except those that timed out waiting for a
+// busy backend, which count as attempts
+func (me *External) deliverDurable(e *DurableEntry, conf QueueConfig, done func(*Response)) {
+	var resp *Response
+	retries, sheds := 0, 0
+	for {
+		resp = me.send(e.request(time.Now().Add(me.timeout(conf))), conf)
+		resp.readAll()
+		if resp.HTTPStatus < 500 {
+			break
+		}
+
+		var delay time.Duration
+		if isShed(resp) && resp.Error.Code != CodeWaitTimeout {
+			sheds++
+			delay = shedBackoff(sheds)
+		} else if retries < conf.Retry.Retries {
+			retries++
+			delay = conf.Retry.delay(retries)
+		} else {
+			log.Println("retinaws: durable request failed on queue:", e.Queue, "-", e.ID, resp.HTTPStatus, string(resp.Body))
+			// the first attempt and each retry
+			me.deadLetter(e, conf, resp, retries+1)
+			break
+		}
+		time.Sleep(delay)
+	}
+
+	if err := me.Durable.done(e.Queue, e.ID); err != nil {
+		log.Println("retinaws: cannot mark request done on queue:", e.Queue, "-", e.ID, err)
+	}
+	if done != nil {
+		done(resp)
+	}
+}
+
+const maxShedBackoff = 30 * time.Second
+
+func shedBackoff(sheds int) time.Duration {
+	if sheds > 5 {
+		return maxShedBackoff
+	}
+	delay := time.Second << uint(sheds-1)
+	if delay > maxShedBackoff {
+		return maxShedBackoff
+	}
+	return delay
+}
+
+// isShed reports whether the router refused the request before it
+// reached a backend
+func isShed(resp *Response) bool {
+	if resp.Error == nil {
+		return false
+	}
+	for err, e := range shedErrors {
+		if err != ErrTimeout && e.Code == resp.Error.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplayDurable delivers the requests left pending in Durable by an
+// earlier run. Call once the Router is configured
+func (me *External) ReplayDurable() {
+	if me.Durable == nil {
+		return
+	}
+	for _, queue := range me.Durable.Queues() {
+		entries := me.Durable.Pending(queue)
+		if len(entries) == 0 {
+			continue
+		}
+		log.Println("retinaws: replaying", len(entries), "durable requests on queue:", queue)
+		conf := me.Router.Config(queue)
+		jobs := make([]durableJob, len(entries))
+		for i, e := range entries {
+			jobs[i] = durableJob{e: e, conf: conf}
+		}
+		me.queueDurable(jobs...)
+	}
+}
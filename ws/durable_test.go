@@ -0,0 +1,114 @@
+package retinaws
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DurableSuite struct{}
+
+var _ = Suite(&DurableSuite{})
+
+func (s *DurableSuite) TestCompactWhileDelivering(c *C) {
+	store, err := OpenDurableStore(c.MkDir())
+	c.Assert(err, IsNil)
+	defer store.Close()
+	// rewrite the log on every done request, while others are sent
+	store.CompactAfter = 1
+
+	internal := &Internal{Router: NewRouter()}
+	internal.Router.Configure("jobs", QueueConfig{Async: true, Durable: true})
+	url, stop := startHub(internal)
+	defer stop()
+
+	var lock sync.Mutex
+	handled := make(map[string]bool)
+	running, most := 0, 0
+	b := &Backend{
+		URL:     url + "jobs",
+		Workers: 32,
+		Handler: func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			lock.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			lock.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			lock.Lock()
+			running--
+			handled[string(body)] = true
+			lock.Unlock()
+			return nil, nil
+		},
+	}
+	done := make(chan bool)
+	defer close(done)
+	go b.Serve(done)
+	time.Sleep(100 * time.Millisecond)
+
+	external := &External{Router: internal.Router, Timeout: 2 * time.Second, Durable: store, DurableWorkers: 4}
+	route := &Route{External: external, Queue: "jobs"}
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, httptest.NewRequest("POST", "/jobs", strings.NewReader("job-"+strconv.Itoa(i))))
+		c.Assert(w.Code, Equals, 202)
+	}
+
+	wait := func() {
+		for i := 0; i < 200 && len(store.Pending("jobs")) > 0; i++ {
+			time.Sleep(25 * time.Millisecond)
+		}
+	}
+	wait()
+
+	// requests left by an earlier run share the same workers
+	for i := 100; i < 150; i++ {
+		e := entryOf(&Request{ID: RandHex(8), Queue: "jobs", Headers: map[string][]string{}, Body: []byte("job-" + strconv.Itoa(i))})
+		c.Assert(store.add(e), IsNil)
+	}
+	external.ReplayDurable()
+	wait()
+	c.Check(store.Pending("jobs"), HasLen, 0)
+	lock.Lock()
+	defer lock.Unlock()
+	c.Check(handled, HasLen, 150)
+	c.Check(most <= 4, Equals, true, Commentf("%d requests delivered at once", most))
+}
+
+func (s *DurableSuite) TestWaitTimeoutCountsAsAttempt(c *C) {
+	store, err := OpenDurableStore(c.MkDir())
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	// a backend that never takes requests
+	router := NewRouter()
+	router.register([]string{"busy"}, "")
+	router.Configure("busy", QueueConfig{
+		QueueLimits: QueueLimits{MaxWait: 10 * time.Millisecond},
+		Async:       true,
+		Durable:     true,
+		DeadLetter:  true,
+		Retry:       RetryPolicy{Retries: 1, Backoff: time.Millisecond},
+	})
+	external := &External{Router: router, Timeout: time.Second, Durable: store, DeadLetters: &DeadLetterStore{}}
+
+	e := entryOf(&Request{ID: RandHex(8), Queue: "busy", Headers: map[string][]string{}, Body: []byte("job")})
+	c.Assert(store.add(e), IsNil)
+	finished := make(chan *Response, 1)
+	go external.deliverDurable(e, router.Config("busy"), func(resp *Response) { finished <- resp })
+	select {
+	case resp := <-finished:
+		c.Check(resp.Error.Code, Equals, CodeWaitTimeout)
+	case <-time.After(5 * time.Second):
+		c.Fatal("request waiting for a busy backend was retried without limit")
+	}
+	dead := external.DeadLetters.List("busy")
+	c.Assert(dead, HasLen, 1)
+	c.Check(dead[0].Attempts, Equals, 2)
+	c.Check(store.Pending("busy"), HasLen, 0)
+}
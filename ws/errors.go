@@ -0,0 +1,140 @@
+package retinaws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Error codes used in hub error responses. These are stable and
+// safe for client libraries to switch on
+const (
+	CodeBadRequest           = "bad_request"
+	CodeQueueUndefined       = "queue_undefined"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeNotAcceptable        = "not_acceptable"
+	CodeBodyTooLarge         = "body_too_large"
+	CodeResponseTooLarge     = "response_too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeNoBackend            = "no_backend"
+	CodeQueueFull            = "queue_full"
+	CodeOverloaded           = "overloaded"
+	CodeWaitTimeout          = "wait_timeout"
+	CodeTimeout              = "timeout"
+	CodeBackendError         = "backend_error"
+	CodeCallDepth            = "call_depth_exceeded"
+	CodeInternal             = "internal_error"
+)
+
+// HubError is an error returned to a client by Retina, or a
+// structured error returned by a backend.
+//
+// Clients accepting application/json (the default) receive:
+//
+//	{"error": {"code": "no_backend", "message": "...", "request_id": "..."}}
+//
+// Clients that only accept text/plain receive "code: message".
+//
+// Backends return a structured error by setting the X-Hub-Error
+// header to a code, optionally with X-Hub-Error-Message (the body
+// is used otherwise) and X-Hub-Status (500 if unset)
+type HubError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *HubError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Headers returns the reply headers a backend sends to return e,
+// such as an error from a nested Call
+func (e *HubError) Headers() map[string][]string {
+	return map[string][]string{
+		"X-Hub-Status":        []string{strconv.Itoa(e.Status)},
+		"X-Hub-Error":         []string{e.Code},
+		"X-Hub-Error-Message": []string{e.Message},
+	}
+}
+
+func newError(status int, code, message string) *HubError {
+	return &HubError{Status: status, Code: code, Message: message}
+}
+
+// shedErrors maps Router errors to the error returned to clients
+var shedErrors = map[error]*HubError{
+	ErrNoBackend:   newError(503, CodeNoBackend, ErrNoBackend.Error()),
+	ErrQueueFull:   newError(503, CodeQueueFull, ErrQueueFull.Error()),
+	ErrOverloaded:  newError(503, CodeOverloaded, ErrOverloaded.Error()),
+	ErrWaitTimeout: newError(503, CodeWaitTimeout, ErrWaitTimeout.Error()),
+	ErrTimeout:     newError(504, CodeTimeout, ErrTimeout.Error()),
+}
+
+func routerError(err error) *HubError {
+	e, ok := shedErrors[err]
+	if !ok {
+		return newError(500, CodeInternal, err.Error())
+	}
+	return e
+}
+
+// backendError returns the structured error in a backend reply,
+// or nil if the reply is not an error
+func backendError(status int, headers map[string][]string, body []byte) *HubError {
+	code := firstHeader(headers, "X-Hub-Error")
+	if code == "" {
+		return nil
+	}
+	if _, ok := headers["X-Hub-Status"]; !ok {
+		status = 500
+	}
+	message := firstHeader(headers, "X-Hub-Error-Message")
+	if message == "" {
+		message = string(body)
+	}
+	return newError(status, code, message)
+}
+
+func responseTooLarge(size int, limit int64) *HubError {
+	return newError(502, CodeResponseTooLarge, fmt.Sprintf("reply body of %d bytes exceeds limit of %d", size, limit))
+}
+
+func firstHeader(headers map[string][]string, name string) string {
+	vals := headers[name]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// wantsText reports whether the client prefers plain text errors
+func wantsText(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "json")
+}
+
+// writeError writes e to the client in the negotiated format
+func writeError(w http.ResponseWriter, req *http.Request, e *HubError) {
+	headers := w.Header()
+	if e.RequestID != "" {
+		headers.Set("X-Request-Id", e.RequestID)
+	}
+
+	var body []byte
+	if wantsText(req) {
+		headers.Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(fmt.Sprintf("%s: %s\n", e.Code, e.Message))
+	} else {
+		headers.Set("Content-Type", "application/json")
+		body, _ = json.Marshal(map[string]*HubError{"error": e})
+	}
+	headers.Set("Content-Length", strconv.Itoa(len(body)))
+	headers.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
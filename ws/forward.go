@@ -0,0 +1,88 @@
+package retinaws
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Hop-by-hop headers apply to a single connection and are not
+// forwarded to backends
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardHeaders returns the headers sent to the backend for hr.
+// Client supplied X-Hub-* headers are reserved for the hub and
+// dropped, as are hop-by-hop headers. Connection metadata is added
+// as X-Hub-* and standard X-Forwarded-* / Forwarded headers
+func forwardHeaders(hr *http.Request, vhost string) map[string][]string {
+	headers := make(map[string][]string, len(hr.Header)+10)
+	for name, vals := range hr.Header {
+		if !strings.HasPrefix(name, "X-Hub-") {
+			headers[name] = vals
+		}
+	}
+
+	for _, conn := range hr.Header["Connection"] {
+		for _, name := range strings.Split(conn, ",") {
+			delete(headers, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+	}
+	for _, name := range hopHeaders {
+		delete(headers, name)
+	}
+
+	proto := "http"
+	tls := "off"
+	if hr.TLS != nil {
+		proto = "https"
+		tls = "on"
+	}
+	if vhost == "" {
+		vhost = hr.Host
+	}
+	clientIP, _, err := net.SplitHostPort(hr.RemoteAddr)
+	if err != nil {
+		clientIP = hr.RemoteAddr
+	}
+
+	headers["X-Hub-Method"] = []string{hr.Method}
+	headers["X-Hub-Uri"] = []string{hr.RequestURI}
+	headers["X-Hub-Remote-Addr"] = []string{hr.RemoteAddr}
+	headers["X-Hub-Tls"] = []string{tls}
+	headers["X-Hub-Vhost"] = []string{vhost}
+
+	if prior := strings.Join(hr.Header["X-Forwarded-For"], ", "); prior != "" {
+		headers["X-Forwarded-For"] = []string{prior + ", " + clientIP}
+	} else {
+		headers["X-Forwarded-For"] = []string{clientIP}
+	}
+	headers["X-Forwarded-Proto"] = []string{proto}
+	headers["X-Forwarded-Host"] = []string{hr.Host}
+
+	forwarded := "for=" + forwardedNode(clientIP) + ";host=\"" + hr.Host + "\";proto=" + proto
+	if prior := strings.Join(hr.Header["Forwarded"], ", "); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	headers["Forwarded"] = []string{forwarded}
+
+	return headers
+}
+
+// forwardedNode formats an address for the Forwarded header (RFC 7239).
+// IPv6 addresses must be bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "\"[" + ip + "]\""
+	}
+	return ip
+}
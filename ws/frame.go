@@ -0,0 +1,226 @@
+package retinaws
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Websocket subprotocols used to negotiate the frame format. A peer
+// that does not negotiate a subprotocol is assumed to speak v1
+const (
+	SubprotocolV1 = "retina.v1"
+	SubprotocolV2 = "retina.v2"
+)
+
+// Subprotocols lists the frame formats we support, most preferred first
+var Subprotocols = []string{SubprotocolV2, SubprotocolV1}
+
+// ControlOp identifies hub control frames
+type ControlOp byte
+
+const (
+	// Regular request or reply
+	OpNone ControlOp = iota
+
+	// Backend received a request
+	OpAck
+
+	// Request from a client to a queue, see External.call
+	OpCall
+
+	// Response to an OpCall
+	OpResult
+
+	// Part of a streamed reply. The first carries the reply status
+	// and headers, the final reply frame ends the stream
+	OpChunk
+
+	// Hub has passed X-Hub-Credit more bytes of a streamed reply on
+	// to the client, so the backend may send as many more
+	OpCredit
+
+	// Hub has aborted a streamed reply, for the error in the headers.
+	// The backend should stop sending it
+	OpCancel
+)
+
+// names used for control ops in the X-Hub-ControlOp header of v1 frames
+var opNames = map[ControlOp]string{
+	OpAck:    "ack",
+	OpCall:   "call",
+	OpResult: "result",
+	OpChunk:  "chunk",
+	OpCredit: "credit",
+	OpCancel: "cancel",
+}
+
+// Frame is a message exchanged between the hub and a backend
+type Frame struct {
+	Op      ControlOp
+	Headers map[string][]string
+	Body    []byte
+}
+
+// FrameCodec converts frames to and from websocket messages
+type FrameCodec interface {
+	Encode(f *Frame) []byte
+	Decode(data []byte) (*Frame, error)
+}
+
+// codecFor returns the codec for a negotiated subprotocol
+func codecFor(subprotocol string) FrameCodec {
+	if subprotocol == SubprotocolV2 {
+		return FrameV2
+	}
+	return FrameV1
+}
+
+// FrameV1 is the original text format: CRLF separated "name:value"
+// header lines, a blank line, then the body. Control ops are sent
+// in the X-Hub-ControlOp header
+var FrameV1 FrameCodec = frameV1{}
+
+type frameV1 struct{}
+
+func (frameV1) Encode(f *Frame) []byte {
+	headers := f.Headers
+	if name, ok := opNames[f.Op]; ok {
+		headers = make(map[string][]string, len(f.Headers)+1)
+		for k, v := range f.Headers {
+			headers[k] = v
+		}
+		headers["X-Hub-ControlOp"] = []string{name}
+	}
+	return WriteFrame(headers, f.Body)
+}
+
+func (frameV1) Decode(data []byte) (*Frame, error) {
+	parsed, body := ParseFrame(data)
+	headers := make(map[string][]string, len(parsed))
+	for name, vals := range parsed {
+		key := headerKey(name)
+		headers[key] = append(headers[key], vals...)
+	}
+	f := &Frame{Headers: headers, Body: body}
+	if ops := headers[headerKey("X-Hub-ControlOp")]; len(ops) > 0 {
+		for op, name := range opNames {
+			if ops[0] == name {
+				f.Op = op
+			}
+		}
+	}
+	return f, nil
+}
+
+// FrameV2 is a length-prefixed binary format:
+//
+//	version byte (2)
+//	op byte
+//	uvarint header count, then per header:
+//	    uvarint name length, name, uvarint value length, value
+//	uvarint body length, body
+//
+// Unlike v1, header values may contain any bytes, including CR and LF
+var FrameV2 FrameCodec = frameV2{}
+
+type frameV2 struct{}
+
+const frameV2Version = 2
+
+var errBadFrame = errors.New("retinaws: malformed v2 frame")
+
+func (frameV2) Encode(f *Frame) []byte {
+	size := 2 + binary.MaxVarintLen64*2 + len(f.Body)
+	count := 0
+	for name, vals := range f.Headers {
+		for _, val := range vals {
+			size += binary.MaxVarintLen64*2 + len(name) + len(val)
+			count++
+		}
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, frameV2Version, byte(f.Op))
+	buf = binary.AppendUvarint(buf, uint64(count))
+	for name, vals := range f.Headers {
+		for _, val := range vals {
+			buf = appendBytes(buf, []byte(name))
+			buf = appendBytes(buf, []byte(val))
+		}
+	}
+	return appendBytes(buf, f.Body)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func (frameV2) Decode(data []byte) (*Frame, error) {
+	if len(data) < 2 || data[0] != frameV2Version {
+		return nil, errBadFrame
+	}
+	f := &Frame{Op: ControlOp(data[1]), Headers: make(map[string][]string)}
+	pos := 2
+
+	count, err := readUvarint(data, &pos)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < count; i++ {
+		name, err := readBytes(data, &pos)
+		if err != nil {
+			return nil, err
+		}
+		val, err := readBytes(data, &pos)
+		if err != nil {
+			return nil, err
+		}
+		key := headerKey(string(name))
+		f.Headers[key] = append(f.Headers[key], string(val))
+	}
+
+	f.Body, err = readBytes(data, &pos)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path variables are passed to backends as X-Hub-Var-{name}
+const varHeaderPrefix = "X-Hub-Var-"
+
+// headerKey canonicalizes a header name as net/http does, so peers
+// may send names in any case. Path variable names are case sensitive
+// and kept as sent
+func headerKey(name string) string {
+	key := http.CanonicalHeaderKey(name)
+	if strings.HasPrefix(key, varHeaderPrefix) {
+		return varHeaderPrefix + name[len(varHeaderPrefix):]
+	}
+	return key
+}
+
+func readUvarint(data []byte, pos *int) (uint64, error) {
+	n, size := binary.Uvarint(data[*pos:])
+	if size <= 0 {
+		return 0, errBadFrame
+	}
+	*pos += size
+	return n, nil
+}
+
+func readBytes(data []byte, pos *int) ([]byte, error) {
+	n, err := readUvarint(data, pos)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(data)-*pos) {
+		return nil, errBadFrame
+	}
+	b := data[*pos : *pos+int(n)]
+	*pos += int(n)
+	return b, nil
+}
@@ -0,0 +1,37 @@
+package retinaws
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type FrameSuite struct{}
+
+var _ = Suite(&FrameSuite{})
+
+func (s *FrameSuite) TestDecodeCanonicalizesHeaderNames(c *C) {
+	headers := map[string][]string{
+		"x-hub-status":     {"201"},
+		"X-Hub-Var-userId": {"42"},
+	}
+	for _, codec := range []FrameCodec{FrameV1, FrameV2} {
+		f, err := codec.Decode(codec.Encode(&Frame{Op: OpAck, Headers: headers}))
+		c.Assert(err, IsNil)
+		c.Check(f.Op, Equals, OpAck)
+		c.Check(f.Headers["X-Hub-Status"], DeepEquals, []string{"201"})
+		c.Check(f.Headers["X-Hub-Var-userId"], DeepEquals, []string{"42"})
+	}
+}
+
+func (s *FrameSuite) TestV2HeaderValuesMayHoldCRLF(c *C) {
+	f := &Frame{
+		Op:      OpChunk,
+		Headers: map[string][]string{"X-Note": {"line 1\r\nline 2", ""}},
+		Body:    []byte("\r\n\r\nbody"),
+	}
+	decoded, err := FrameV2.Decode(FrameV2.Encode(f))
+	c.Assert(err, IsNil)
+	c.Check(decoded, DeepEquals, f)
+
+	_, err = FrameV2.Decode(FrameV2.Encode(f)[:10])
+	c.Check(err, Equals, errBadFrame)
+}
@@ -0,0 +1,133 @@
+package retinaws
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPHandler adapts h to a MessageHandler, so an existing
+// http.Handler can serve hub queues. Each request is rebuilt from the
+// hub metadata: method, URI, client headers and address. Its context
+// ends at the hub deadline.
+//
+// Output is sent as a single reply unless h flushes it (see
+// http.Flusher) or writes more than streamThreshold bytes, in which
+// case the reply is streamed to the client
+func (b *Backend) HTTPHandler(h http.Handler) MessageHandler {
+	return func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		req, cancel, err := httpRequest(headers, body)
+		if err != nil {
+			return newError(400, CodeBadRequest, err.Error()).Headers(), nil
+		}
+		defer cancel()
+
+		w := &replyWriter{backend: b, parent: headers, header: make(http.Header)}
+		h.ServeHTTP(w, req)
+		return w.finish()
+	}
+}
+
+// httpRequest builds the request a backend received from the hub
+func httpRequest(headers map[string][]string, body []byte) (*http.Request, context.CancelFunc, error) {
+	method := firstHeader(headers, "X-Hub-Method")
+	if method == "" {
+		method = "POST"
+	}
+	uri := firstHeader(headers, "X-Hub-Uri")
+	if uri == "" {
+		uri = "/" + firstHeader(headers, "X-Hub-Queue")
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if ms, err := strconv.ParseInt(firstHeader(headers, "X-Hub-Deadline"), 10, 64); err == nil {
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, ms*int64(time.Millisecond)))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	for name, vals := range headers {
+		if !strings.HasPrefix(name, "X-Hub-") {
+			req.Header[http.CanonicalHeaderKey(name)] = vals
+		}
+	}
+	req.RequestURI = uri
+	req.Host = firstHeader(headers, "X-Forwarded-Host")
+	req.RemoteAddr = firstHeader(headers, "X-Hub-Remote-Addr")
+	return req, cancel, nil
+}
+
+// Buffered output above which a reply is streamed
+const streamThreshold = 64 * 1024
+
+// replyWriter captures the output of an http.Handler as a reply
+type replyWriter struct {
+	backend *Backend
+	parent  map[string][]string
+
+	header http.Header
+	status int
+	buf    bytes.Buffer
+
+	// set once the reply is streamed
+	stream *ReplyStream
+	err    error
+}
+
+func (w *replyWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *replyWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *replyWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	if w.buf.Len() >= streamThreshold {
+		w.Flush()
+	}
+	return len(p), w.err
+}
+
+// Flush sends the output written so far, starting a streamed reply
+func (w *replyWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return
+	}
+	if w.stream == nil {
+		w.stream, w.err = w.backend.Stream(w.parent, w.status, w.header)
+		if w.err != nil {
+			return
+		}
+	}
+	_, w.err = w.stream.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// finish returns the reply, or the last part of a streamed reply
+func (w *replyWriter) finish() (map[string][]string, []byte) {
+	if w.stream != nil {
+		return nil, w.buf.Bytes()
+	}
+	w.WriteHeader(http.StatusOK)
+	reply := make(map[string][]string, len(w.header)+1)
+	for name, vals := range w.header {
+		reply[name] = vals
+	}
+	reply["X-Hub-Status"] = []string{strconv.Itoa(w.status)}
+	return reply, w.buf.Bytes()
+}
@@ -3,11 +3,9 @@ package retinaws
 import (
 	"bytes"
 	"fmt"
-	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,124 +13,581 @@ import (
 )
 
 type Request struct {
-	Queue      string
-	HTTPMethod string
-	HTTPURI    string
-	Headers    map[string][]string
-	Body       []byte
-	Ack        chan bool
-	ReplyTo    chan *Response
-	Deadline   time.Time
+	ID          string
+	Queue       string
+	Priority    int
+	AffinityKey string
+	Version     string
+	HTTPMethod  string
+	HTTPURI     string
+	Headers     map[string][]string
+	Body        []byte
+
+	// Largest reply body accepted. 0 = limited by the connection only
+	MaxResponseSize int64
+
+	// IDs of the requests whose handlers made this request through a
+	// chain of calls, outermost first. Empty for external requests
+	Chain []string
+
+	Ack      chan bool
+	ReplyTo  chan *Response
+	Deadline time.Time
 }
 
 type Response struct {
 	HTTPStatus int
 	Headers    map[string][]string
 	Body       []byte
+
+	// Set for errors, which are written in the format the client accepts
+	Error *HubError
+
+	// Parts of a streamed reply that follow Body. Closed at the end
+	Stream <-chan []byte
+
+	// the hub side of Stream, with the error if it was cut short
+	stream *replyStream
+}
+
+// readAll appends the rest of a streamed reply to Body. A reply cut
+// short is turned into its error
+func (me *Response) readAll() {
+	if me.Stream == nil {
+		return
+	}
+	for chunk := range me.Stream {
+		me.Body = append(me.Body, chunk...)
+	}
+	me.Stream = nil
+	if err := me.streamErr(); err != nil {
+		*me = *errorResponse(err)
+	}
+}
+
+// streamErr returns the error that cut a streamed reply short. Only
+// valid once Stream is closed
+func (me *Response) streamErr() *HubError {
+	if me.stream == nil {
+		return nil
+	}
+	return me.stream.err
 }
 
 ////////////////////////////////////////////
 
 func NewRouter() *Router {
 	return &Router{
-		byQueue: make(map[string]chan *Request),
+		byQueue: make(map[string]*queue),
+		confs:   make(map[string]QueueConfig),
 		lock:    &sync.Mutex{},
+		started: time.Now(),
 	}
 }
 
 type Router struct {
-	byQueue map[string]chan *Request
+	// Settings for queues without an entry set via Configure
+	Defaults QueueConfig
+
+	// Largest body sent over backend connections, as set on Internal.
+	// Queue MaxBodySize above it is lowered to it. 0 = 4 MiB
+	MaxMessageSize int64
+
+	byQueue map[string]*queue
+	confs   map[string]QueueConfig
 	lock    *sync.Mutex
 	resend  int
+
+	// start of NoBackendGrace for queues that never had a consumer
+	started time.Time
+
+	// consumers subscribed with at least one pattern
+	patterns []*consumer
 }
 
-func (me *Router) Destroy() {
+// Configure overrides the Defaults for a single queue
+func (me *Router) Configure(queue string, conf QueueConfig) {
 	me.lock.Lock()
 	defer me.lock.Unlock()
-	for _, ch := range me.byQueue {
-		close(ch)
+
+	me.confs[queue] = conf
+	q, ok := me.byQueue[queue]
+	if ok {
+		q.conf = me.conf(queue)
+	}
+}
+
+// Config returns the settings in effect for the given queue
+func (me *Router) Config(queue string) QueueConfig {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return me.conf(queue)
+}
+
+// conf returns the settings for queue, with its body limit lowered
+// to what a backend connection carries. Caller must hold me.lock
+func (me *Router) conf(queue string) QueueConfig {
+	conf, ok := me.confs[queue]
+	if !ok {
+		conf = me.Defaults
+	}
+	limit := me.MaxMessageSize
+	if limit <= 0 {
+		limit = maxMessageSize
+	}
+	if conf.bodyLimit() > limit {
+		conf.MaxBodySize = limit
 	}
-	me.byQueue = make(map[string]chan *Request)
+	return conf
 }
 
-func (me *Router) getQueueChannel(queue string) chan *Request {
+func (me *Router) Destroy() {
 	me.lock.Lock()
 	defer me.lock.Unlock()
+	for _, q := range me.byQueue {
+		for _, c := range append(q.consumers, q.matched...) {
+			select {
+			case <-c.done:
+			default:
+				close(c.done)
+			}
+		}
+	}
+	me.byQueue = make(map[string]*queue)
+	me.patterns = nil
+}
 
-	ch, ok := me.byQueue[queue]
+// getQueue returns the queue with the given name, creating it
+// if necessary. Caller must hold me.lock
+func (me *Router) getQueue(name string) *queue {
+	q, ok := me.byQueue[name]
 	if !ok {
-		ch = make(chan *Request)
-		me.byQueue[queue] = ch
+		q = newQueue(me.conf(name))
+		q.idle = me.started
+		me.byQueue[name] = q
+		for _, c := range me.patterns {
+			if c.matches(name) {
+				me.bind(c, name, q)
+			}
+		}
+	}
+	return q
+}
+
+// bind subscribes c to q through one of its patterns. Caller must hold me.lock
+func (me *Router) bind(c *consumer, name string, q *queue) {
+	for _, bound := range c.queues {
+		if bound == name {
+			return
+		}
+	}
+	c.queues = append(c.queues, name)
+	q.subscribePattern(c)
+}
+
+// register subscribes a backend connection to the given queues.
+// Subscriptions containing glob characters are patterns matched
+// against queue names, including queues created later
+func (me *Router) register(subscriptions []string, version string) *consumer {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	c := newConsumer(version)
+	for _, name := range subscriptions {
+		if isPattern(name) {
+			c.patterns = append(c.patterns, name)
+		} else {
+			c.queues = append(c.queues, name)
+			me.getQueue(name).subscribe(c)
+		}
 	}
-	return ch
+	if len(c.patterns) > 0 {
+		me.patterns = append(me.patterns, c)
+		for name, q := range me.byQueue {
+			if c.matches(name) {
+				me.bind(c, name, q)
+			}
+		}
+	}
+	c.wake()
+	return c
 }
 
-func (me *Router) send(req *Request) {
-	ch := me.getQueueChannel(req.Queue)
-	ackTimeout := req.Deadline.Sub(time.Now()) / 3
-	for time.Now().Before(req.Deadline) {
+// setHealthy excludes a suspect consumer from affinity targets,
+// moving its pinned requests to another consumer
+func (me *Router) setHealthy(c *consumer, healthy bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if c.healthy == healthy {
+		return
+	}
+	c.healthy = healthy
+	for _, name := range c.queues {
+		me.getQueue(name).changed()
+	}
+}
+
+func (me *Router) unregister(c *consumer) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	now := time.Now()
+	for _, name := range c.queues {
+		me.getQueue(name).unsubscribe(c, now)
+	}
+	me.patterns = removeConsumer(me.patterns, c)
+}
+
+// take removes the request the consumer should handle next from
+// its queues, or returns nil if none are waiting. Higher effective
+// priority wins, ties go to the oldest request
+func (me *Router) take(c *consumer) *Request {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	now := time.Now()
+	var bestQ *queue
+	bestIdx, bestPrio := -1, 0
+	for _, name := range c.queues {
+		q := me.getQueue(name)
+		idx, prio := q.best(c, now)
+		if idx < 0 {
+			continue
+		}
+		if bestQ == nil || prio > bestPrio ||
+			(prio == bestPrio && q.waiting[idx].enqueued.Before(bestQ.waiting[bestIdx].enqueued)) {
+			bestQ, bestIdx, bestPrio = q, idx, prio
+		}
+	}
+
+	if bestQ == nil {
+		return nil
+	}
+	return bestQ.take(bestIdx, now)
+}
+
+// admit reserves a slot on the request's queue. On success the
+// caller must pass the queue to deliver, which releases the slot
+func (me *Router) admit(req *Request) (*queue, QueueLimits, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	q := me.getQueue(req.Queue)
+	return q, q.conf.QueueLimits, q.admit(time.Now())
+}
+
+// deliver queues an admitted request until a backend takes it,
+// re-queueing it until the backend acks it or the deadline passes
+func (me *Router) deliver(q *queue, limits QueueLimits, req *Request) error {
+	defer func() {
+		me.lock.Lock()
+		q.release()
+		me.lock.Unlock()
+	}()
+
+	start := time.Now()
+	waitDeadline := req.Deadline
+	if limits.MaxWait > 0 && start.Add(limits.MaxWait).Before(waitDeadline) {
+		waitDeadline = start.Add(limits.MaxWait)
+	}
+
+	w := &waiter{req: req, taken: make(chan bool, 1)}
+	me.lock.Lock()
+	q.push(w, start)
+	me.lock.Unlock()
+
+	accepted := false
+	ackTimeout := req.Deadline.Sub(start) / 3
+	for {
+		deadline := req.Deadline
+		var lateAck chan bool
+		if accepted {
+			lateAck = req.Ack
+		} else {
+			deadline = waitDeadline
+		}
+
 		select {
-		case ch <- req:
+		case <-lateAck:
+			// an earlier attempt was acked after all
+			me.lock.Lock()
+			q.remove(w)
+			me.lock.Unlock()
+			return nil
+		case <-w.taken:
+			accepted = true
 			select {
 			case <-req.Ack:
-				return
+				return nil
 			case <-time.After(ackTimeout):
-				// re-send
+				if !time.Now().Before(req.Deadline) {
+					return ErrTimeout
+				}
+				// re-send, keeping the priority it gained while waiting
 				me.lock.Lock()
 				me.resend++
+				q.push(w, w.enqueued)
 				me.lock.Unlock()
 				log.Println("router resend: ", me.resend, string(req.Body))
 			}
-		case <-time.After(time.Second):
-			// try again
+		case <-time.After(deadline.Sub(time.Now())):
+			me.lock.Lock()
+			removed := q.remove(w)
+			me.lock.Unlock()
+			if !removed {
+				// taken by a backend just as the deadline passed
+				continue
+			}
+			if accepted || !waitDeadline.Before(req.Deadline) {
+				// the request's own deadline passed, not MaxWait
+				return ErrTimeout
+			}
+			return ErrWaitTimeout
 		}
 	}
 }
 
 ////////////////////////////////////////////
 
-var timeoutResponse = &Response{
-	HTTPStatus: 504,
-	Body:       []byte("Request timed out"),
+var timeoutResponse = errorResponse(routerError(ErrTimeout))
+
+func errorResponse(e *HubError) *Response {
+	return &Response{HTTPStatus: e.Status, Error: e}
+}
+
+func unavailableResponse(err error, retryAfter int) *Response {
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	resp := errorResponse(routerError(err))
+	resp.Headers = map[string][]string{"Retry-After": []string{strconv.Itoa(retryAfter)}}
+	return resp
+}
+
+func acceptedResponse(req *Request) *Response {
+	return &Response{
+		HTTPStatus: 202,
+		Headers:    map[string][]string{"X-Request-Id": []string{req.ID}},
+		Body:       []byte("Accepted"),
+	}
 }
 
 type External struct {
-	Router  *Router
+	Router *Router
+
+	// Request timeout for queues that do not configure one
 	Timeout time.Duration
+
+	// Log of requests on durable queues. Nil = Durable is ignored
+	Durable *DurableStore
+
+	// Requests on dead-lettering queues whose retries ran out. Nil =
+	// DeadLetter is ignored
+	DeadLetters *DeadLetterStore
+
+	// Most durable requests delivered at once, including those replayed
+	// by ReplayDurable. 0 = 256
+	DurableWorkers int
+
+	mirrorLock  sync.Mutex
+	mirrorStats map[string]*MirrorStats
+
+	// durable requests waiting for one of the running workers
+	durableLock    sync.Mutex
+	durableJobs    []durableJob
+	durableRunning int
 }
 
 func (me *External) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	queue, ok := vars["queue"]
-	if queue == "" || !ok {
-		fmt.Fprintf(w, "queue is undefined on URL")
-	} else {
-		r, err := me.fromHttpRequest(queue, req)
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "Error reading req: %v", err)
+	me.serve(w, req, &Route{External: me})
+}
+
+func (me *External) serve(w http.ResponseWriter, req *http.Request, route *Route) {
+	id := RandHex(8)
+	fail := func(e *HubError) {
+		e.RequestID = id
+		writeError(w, req, e)
+	}
+
+	queue, params := route.queue(req)
+	if queue == "" {
+		fail(newError(404, CodeQueueUndefined, "queue is undefined on URL"))
+		return
+	}
+
+	conf := me.Router.Config(queue)
+	if !conf.allowsMethod(req.Method) {
+		w.Header().Set("Allow", strings.Join(conf.Methods, ", "))
+		fail(newError(405, CodeMethodNotAllowed, "method not allowed on queue: "+queue))
+		return
+	}
+	if req.ContentLength > conf.bodyLimit() {
+		fail(newError(413, CodeBodyTooLarge, "request body too large"))
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, conf.bodyLimit())
+
+	r, err := me.fromHttpRequest(id, queue, params, req, route, conf)
+	if err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			fail(newError(413, CodeBodyTooLarge, "request body too large"))
 		} else {
-			resp := me.send(r)
-			if resp.Headers != nil {
-				headers := w.Header()
-				for name, val := range resp.Headers {
-					if !strings.HasPrefix(name, "X-Hub-") {
-						headers[name] = val
-					}
-				}
+			fail(newError(400, CodeBadRequest, fmt.Sprintf("error reading request: %v", err)))
+		}
+		return
+	}
+
+	resp := me.dispatch(r, conf)
+	w.Header().Set("X-Request-Id", id)
+	if resp.Headers != nil {
+		headers := w.Header()
+		for name, val := range resp.Headers {
+			if !strings.HasPrefix(name, "X-Hub-") {
+				headers[name] = val
 			}
-			status := resp.HTTPStatus
-			if status == 0 {
-				status = 200
+		}
+	}
+	if resp.Error != nil {
+		// copy since shared errors such as timeoutResponse are reused
+		e := *resp.Error
+		fail(&e)
+		return
+	}
+	status := resp.HTTPStatus
+	if status == 0 {
+		status = 200
+	}
+	w.WriteHeader(status)
+	w.Write(resp.Body)
+	if resp.Stream != nil {
+		flusher, _ := w.(http.Flusher)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			chunk, ok := <-resp.Stream
+			if !ok {
+				break
 			}
-			w.WriteHeader(status)
-			w.Write(resp.Body)
+			// keep reading after write errors so the backend is not blocked
+			w.Write(chunk)
+		}
+		// the status is sent, so drop the connection rather than let
+		// the client take the reply as complete
+		if resp.streamErr() != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// dispatch sends the request to the queue, mirroring it if configured
+func (me *External) dispatch(r *Request, conf QueueConfig) *Response {
+	primary := me.startMirror(r, conf)
+	start := time.Now()
+	done := func(resp *Response) {
+		if primary != nil {
+			primary <- resultOf(resp, start)
+		}
+	}
+
+	if conf.Async {
+		if conf.Durable && me.Durable != nil {
+			return me.sendDurable(r, conf, done)
+		}
+		return me.sendAsync(r, conf, done)
+	}
+	resp := me.sendWithRetry(r, conf)
+	done(resp)
+	return resp
+}
+
+func (me *External) timeout(conf QueueConfig) time.Duration {
+	if conf.Timeout > 0 {
+		return conf.Timeout
+	}
+	return me.Timeout
+}
+
+// sendAsync admits the request and processes it in the background.
+// Each attempt gets a full timeout since no client is waiting.
+// done is called with the final response
+func (me *External) sendAsync(req *Request, conf QueueConfig, done func(*Response)) *Response {
+	q, limits, err := me.Router.admit(req)
+	if err != nil {
+		resp := unavailableResponse(err, conf.RetryAfter)
+		done(resp)
+		return resp
+	}
+
+	e := entryOf(req)
+	go func() {
+		resp := me.deliver(q, limits, req, conf)
+		attempts := 1
+		for retry := 1; retry <= conf.Retry.Retries && resp.HTTPStatus >= 500; retry++ {
+			resp.readAll()
+			time.Sleep(conf.Retry.delay(retry))
+			req = req.retry(time.Now().Add(me.timeout(conf)))
+			resp = me.send(req, conf)
+			attempts++
+		}
+		resp.readAll()
+		if resp.HTTPStatus >= 500 {
+			log.Println("retinaws: async request failed on queue:", req.Queue, "-", resp.HTTPStatus, string(resp.Body))
+			me.deadLetter(e, conf, resp, attempts)
 		}
+		done(resp)
+	}()
+	return acceptedResponse(req)
+}
+
+// sendWithRetry sends the request, retrying 5xx responses while
+// the request deadline allows. A request the backends failed on every
+// attempt of a retrying queue is dead-lettered; one shed by the router
+// is not, as the client was told to retry it
+func (me *External) sendWithRetry(req *Request, conf QueueConfig) *Response {
+	// taken before sending adds the hub's headers to the request
+	var e *DurableEntry
+	if conf.DeadLetter && conf.Retry.Retries > 0 {
+		e = entryOf(req)
 	}
+	resp := me.send(req, conf)
+	attempts := 1
+	for retry := 1; retry <= conf.Retry.Retries && resp.HTTPStatus >= 500; retry++ {
+		delay := conf.Retry.delay(retry)
+		if !time.Now().Add(delay).Before(req.Deadline) {
+			break
+		}
+		resp.readAll()
+		time.Sleep(delay)
+		req = req.retry(req.Deadline)
+		resp = me.send(req, conf)
+		attempts++
+	}
+	if e != nil && resp.HTTPStatus >= 500 && !isShed(resp) {
+		me.deadLetter(e, conf, resp, attempts)
+	}
+	return resp
 }
 
-func (me *External) send(req *Request) *Response {
-	me.Router.send(req)
+func (me *External) send(req *Request, conf QueueConfig) *Response {
+	q, limits, err := me.Router.admit(req)
+	if err != nil {
+		log.Println("retinaws: shedding request for queue:", req.Queue, "-", err)
+		return unavailableResponse(err, conf.RetryAfter)
+	}
+	return me.deliver(q, limits, req, conf)
+}
+
+func (me *External) deliver(q *queue, limits QueueLimits, req *Request, conf QueueConfig) *Response {
+	err := me.Router.deliver(q, limits, req)
+	if err == ErrTimeout {
+		return timeoutResponse
+	} else if err != nil {
+		log.Println("retinaws: shedding request for queue:", req.Queue, "-", err)
+		return unavailableResponse(err, conf.RetryAfter)
+	}
 
 	select {
 	case res := <-req.ReplyTo:
@@ -142,25 +597,56 @@ func (me *External) send(req *Request) *Response {
 	}
 }
 
-func (me *External) fromHttpRequest(queue string, hr *http.Request) (*Request, error) {
+func (me *External) fromHttpRequest(id, queue string, params map[string]string, hr *http.Request, route *Route, conf QueueConfig) (*Request, error) {
 	buf := bytes.Buffer{}
 	_, err := buf.ReadFrom(hr.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	headers := forwardHeaders(hr, route.Vhost)
+
+	for name, val := range params {
+		headers[varHeaderPrefix+name] = []string{val}
+	}
+
 	return &Request{
-		HTTPMethod: hr.Method,
-		HTTPURI:    hr.RequestURI,
-		Queue:      queue,
-		Headers:    hr.Header,
-		Body:       buf.Bytes(),
-		Ack:        make(chan bool, 1),
-		ReplyTo:    make(chan *Response, 1),
-		Deadline:   time.Now().Add(me.Timeout),
+		ID:              id,
+		Priority:        route.Priority.priority(hr),
+		AffinityKey:     conf.Affinity.key(hr),
+		Version:         conf.Split.version(hr),
+		HTTPMethod:      hr.Method,
+		HTTPURI:         hr.RequestURI,
+		Queue:           queue,
+		Headers:         headers,
+		Body:            buf.Bytes(),
+		MaxResponseSize: conf.responseLimit(),
+		Ack:             make(chan bool, 1),
+		ReplyTo:         make(chan *Response, 1),
+		Deadline:        time.Now().Add(me.timeout(conf)),
 	}, nil
 }
 
+// copyHeaders returns a deep copy of headers, which can be changed
+// without affecting the original
+func copyHeaders(headers map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(headers)+8)
+	for name, vals := range headers {
+		c[name] = append([]string(nil), vals...)
+	}
+	return c
+}
+
+// retry returns a copy of the request with fresh reply channels, so
+// a late reply to an earlier attempt cannot be mistaken for this one
+func (me *Request) retry(deadline time.Time) *Request {
+	r := *me
+	r.Ack = make(chan bool, 1)
+	r.ReplyTo = make(chan *Response, 1)
+	r.Deadline = deadline
+	return &r
+}
+
 ////////////////////////////////////////////
 
 func NewInternal() *Internal {
@@ -171,22 +657,40 @@ func NewInternal() *Internal {
 
 type Internal struct {
 	Router *Router
+
+	// Heartbeat settings for backend connections. Zero value uses DefaultHeartbeat
+	Heartbeat Heartbeat
+
+	// Compression of requests sent to backends
+	Compression Compression
+
+	// Largest request or reply body sent over backend connections.
+	// Per-queue limits above it are lowered to it. Request bodies are
+	// checked by the Router, so give it the same value. 0 = 4 MiB
+	MaxMessageSize int64
+
+	// Handles requests made by connected clients. Connections that
+	// subscribe to no queues are accepted as clients. Nil = disabled
+	External *External
 }
 
 func (me *Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	queues := parseQueues(r.RequestURI)
-	if len(queues) < 1 {
-		http.Error(w, fmt.Sprintf("Invalid URI: %s - Must specify at least one queue", r.RequestURI), 400)
+	queues := parseQueues(r.URL.Path)
+	if len(queues) < 1 && me.External == nil {
+		writeError(w, r, newError(400, CodeBadRequest, fmt.Sprintf("invalid URI: %s - must specify at least one queue", r.RequestURI)))
 		return
 	}
 
-	ws, err := websocket.Upgrade(w, r, nil, 2048, 2048)
+	// backends may declare a version label for traffic splitting
+	version := r.URL.Query().Get("version")
+
+	ws, err := me.upgrader().Upgrade(w, r, nil)
 	if _, ok := err.(websocket.HandshakeError); ok {
-		http.Error(w, "Not a websocket handshake", 400)
+		writeError(w, r, newError(400, CodeBadRequest, "not a websocket handshake"))
 		return
 	} else if err != nil {
 		log.Println("some issue here", err)
-		http.Error(w, "Unknown server error", 500)
+		writeError(w, r, newError(500, CodeInternal, "unknown server error"))
 		return
 	}
 
@@ -198,23 +702,48 @@ func (me *Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// messages inbound from backend process
 	recv := make(chan *Message)
 
+	// results of client calls, which run in their own goroutines
+	results := make(chan *Frame)
+	quit := make(chan bool)
+	defer close(quit)
+
+	// frame format negotiated with the backend during the handshake
+	codec := codecFor(ws.Subprotocol())
+	encode := func(f *Frame) *Message {
+		return &Message{Type: websocket.BinaryMessage, Data: codec.Encode(me.Compression.compress(f, codec))}
+	}
+
 	// start the connection handler, which manages
 	// reading/writing to the websocket connection
-	go HandleConnection(ws, send, recv)
+	heartbeat := me.Heartbeat.withDefaults()
+	conn := NewConnection(ws, send, recv)
+	conn.SetHeartbeat(heartbeat)
+	conn.SetMaxMessageSize(me.MaxMessageSize)
+	go conn.readPump()
+	go conn.writePump()
 
-	channels := make([]reflect.SelectCase, len(queues)+1)
-	channels[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(recv)}
+	// wakes the loop to re-check liveness while no messages arrive
+	livenessTicker := time.NewTicker(heartbeat.Interval / 2)
+	defer livenessTicker.Stop()
 
-	for i, queue := range queues {
-		ch := me.Router.getQueueChannel(queue)
-		log.Println("registering with queue:", queue)
-		channels[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
-	}
+	log.Println("registering with queues:", queues, "version:", version)
+	c := me.Router.register(queues, version)
+	defer me.Router.unregister(c)
+	liveness := Healthy
 
-	prefix := RandHex(8) + "_"
+	prefix := c.id + "_"
 	count := 0
 	requestMap := make(map[string]*Request)
 
+	// streamed replies in progress. Not reaped with requestMap, so
+	// they may outlast the request deadline
+	streams := make(map[string]*replyStream)
+	defer func() {
+		for _, stream := range streams {
+			stream.abort(errStreamClosed)
+		}
+	}()
+
 	reapRequestMapInterval := 5 * time.Minute
 	nextReap := time.Now().Add(reapRequestMapInterval)
 
@@ -222,7 +751,7 @@ func (me *Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		now := time.Now()
 		if now.After(nextReap) {
 			for id, req := range requestMap {
-				if req.Deadline.Before(now) {
+				if _, streaming := streams[id]; !streaming && req.Deadline.Before(now) {
 					log.Println("retinaws: removing timed out request:", id)
 					delete(requestMap, id)
 				}
@@ -230,43 +759,120 @@ func (me *Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			nextReap = time.Now().Add(reapRequestMapInterval)
 		}
 
-		chosen, value, ok := reflect.Select(channels)
-		if !ok {
-			log.Println("retinaws: reflect.Select returned closed channel - exiting:", chosen)
-			return
+		if l := conn.Liveness(); l != liveness {
+			log.Printf("retinaws: backend %s is now %s", r.RemoteAddr, l)
+			liveness = l
+			me.Router.setHealthy(c, liveness == Healthy)
+		}
+
+		// only take new requests while the backend is healthy
+		var ready chan bool
+		if liveness == Healthy {
+			ready = c.ready
 		}
 
-		if chosen == 0 {
-			// Message from backend process
-			msg, ok := value.Interface().(*Message)
+		select {
+		case msg, ok := <-recv:
 			if !ok {
-				log.Printf("retinaws: ERROR chosen=0 but value is not *Message: %+v", value.Interface())
+				log.Println("retinaws: backend connection closed - exiting:", r.RemoteAddr)
 				return
 			}
 
 			//log.Println("Message from backend: ", msg.MessageType, string(msg.Data), msg.Error)
 			if msg.Type == websocket.BinaryMessage {
-				headers, body := ParseFrame(msg.Data)
+				frame, err := readFrame(codec, msg.Data, me.MaxMessageSize)
+				if err != nil {
+					log.Println("retinaws: invalid frame from backend:", r.RemoteAddr, err)
+					continue
+				}
+				if frame.Op == OpCall {
+					me.startCall(frame, r.RemoteAddr, results, quit)
+					continue
+				}
+				headers, body := frame.Headers, frame.Body
 				ids, ok := headers["X-Hub-Id"]
 				if ok && len(ids) > 0 {
 					id := ids[0]
 					req, ok := requestMap[id]
 					if ok {
-						op, ok := headers["X-Hub-ControlOp"]
-						if ok && len(op) > 0 && op[0] == "ack" {
-							req.Ack <- true
+						if frame.Op == OpAck {
+							select {
+							case req.Ack <- true:
+							default:
+							}
+						} else if stream, ok := streams[id]; ok {
+							// rest of a streamed reply. Parts of an
+							// aborted stream are dropped until its end.
+							// A backend that cannot finish the reply
+							// ends it with an error
+							var err *HubError
+							if frame.Op != OpChunk {
+								status, _ := strconv.Atoi(firstHeader(headers, "X-Hub-Status"))
+								err = backendError(status, headers, body)
+							}
+							if err == nil {
+								err = stream.push(body)
+								if err != nil && stream.notify != nil {
+									send <- encode(cancelFrame(id, err))
+								}
+							}
+							if err != nil {
+								log.Printf("retinaws: aborting stream %s from %s: %s", id, r.RemoteAddr, err.Message)
+								stream.abort(err)
+							}
+							if frame.Op != OpChunk {
+								stream.end()
+								delete(streams, id)
+								delete(requestMap, id)
+							}
 						} else {
 							statusCode := 200
 							status, ok := headers["X-Hub-Status"]
 							if ok && len(status) > 0 {
 								statusCode, _ = strconv.Atoi(status[0])
 							}
-							req.ReplyTo <- &Response{
+							resp := &Response{
 								HTTPStatus: statusCode,
 								Headers:    headers,
 								Body:       body,
+								Error:      backendError(statusCode, headers, body),
+							}
+							// backends that echo the offered window
+							// wait for credit while streaming
+							credited := frame.Op == OpChunk && firstHeader(headers, "X-Hub-Stream-Window") != ""
+							limit := me.responseLimit(req)
+							if int64(len(body)) > limit {
+								log.Printf("retinaws: reply to %s from %s exceeds %d bytes", id, r.RemoteAddr, limit)
+								e := responseTooLarge(len(body), limit)
+								resp = errorResponse(e)
+								if frame.Op == OpChunk {
+									streams[id] = droppedStream()
+									if credited {
+										send <- encode(cancelFrame(id, e))
+									}
+								}
+							} else if frame.Op == OpChunk {
+								stream := newReplyStream(id, int64(len(body)), limit)
+								if credited {
+									stream.notify = func(f *Frame) {
+										select {
+										case results <- f:
+										case <-quit:
+										}
+									}
+								}
+								go stream.forward()
+								streams[id] = stream
+								resp.Stream = stream.parts
+								resp.stream = stream
+							}
+							select {
+							case req.ReplyTo <- resp:
+							default:
+							}
+							if frame.Op != OpChunk {
+								delete(requestMap, id)
 							}
-							delete(requestMap, id)
 						}
 					} else {
 						log.Printf("retinaws: request not found with id: %s", id)
@@ -277,13 +883,21 @@ func (me *Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			} else {
 				log.Println("retinaws: Unknown Message from backend: ", msg.Type, string(msg.Data))
 			}
-		} else {
+		case result := <-results:
+			send <- encode(result)
+		case <-livenessTicker.C:
+			// re-evaluated at top of loop
+		case <-c.done:
+			log.Println("retinaws: router destroyed - exiting:", r.RemoteAddr)
+			return
+		case <-ready:
 			// Inbound HTTP request from external
-			req, ok := value.Interface().(*Request)
-			if !ok {
-				log.Printf("retinaws: value is not *Request: %+v", value.Interface())
-				return
+			req := me.Router.take(c)
+			if req == nil {
+				continue
 			}
+			// there may be more waiting
+			c.wake()
 
 			count++
 			if count < 0 {
@@ -295,13 +909,226 @@ func (me *Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			headers := req.Headers
 			headers["X-Hub-Id"] = []string{id}
 			headers["X-Hub-Queue"] = []string{req.Queue}
-			frame := WriteFrame(headers, req.Body)
-			send <- &Message{Type: websocket.BinaryMessage, Data: frame}
+			headers["X-Hub-Max-Response-Size"] = []string{strconv.FormatInt(me.responseLimit(req), 10)}
+			headers["X-Hub-Stream-Window"] = []string{strconv.Itoa(streamWindow)}
+			headers["X-Hub-Request-Id"] = []string{req.ID}
+			headers["X-Hub-Deadline"] = []string{strconv.FormatInt(req.Deadline.UnixNano()/int64(time.Millisecond), 10)}
+			headers["X-Hub-Call-Chain"] = []string{strings.Join(append(req.Chain[:len(req.Chain):len(req.Chain)], req.ID), ",")}
+			send <- encode(&Frame{Headers: headers, Body: req.Body})
 		}
 	}
 
 }
 
+// Bytes of a streamed reply a backend may send ahead of the client.
+// Backends taking part in flow control (see Backend.Stream) wait for
+// the hub to return credit as the client reads. The stream of one that
+// does not is aborted once the client falls this far behind, so a slow
+// client never holds up the other requests on the connection
+const streamWindow = 1 << 20
+
+// Time a streamed reply waits for its client to take a part before
+// it is aborted
+const streamStall = time.Minute
+
+var (
+	errStreamOverflow = newError(504, CodeTimeout, "client is not reading the streamed reply")
+	errStreamStalled  = newError(504, CodeTimeout, "client stopped reading the streamed reply")
+	errStreamClosed   = newError(502, CodeBackendError, "backend connection closed during streamed reply")
+)
+
+// replyStream is a streamed reply in progress on a backend connection.
+// The connection pushes parts as they arrive and forward hands them to
+// External, returning credit for them to the backend
+type replyStream struct {
+	id string
+
+	// read by External. Closed at the end
+	parts chan []byte
+
+	// sends credit and cancel frames to the backend. Nil if it does
+	// not take part in flow control
+	notify func(*Frame)
+
+	lock sync.Mutex
+	wake chan bool
+
+	// bytes received, and the most accepted
+	size  int64
+	limit int64
+
+	// parts not yet taken by External, and their size
+	queued   [][]byte
+	buffered int64
+
+	ended bool
+
+	// why the stream was aborted. Set before parts is closed
+	err *HubError
+}
+
+func newReplyStream(id string, size, limit int64) *replyStream {
+	return &replyStream{id: id, parts: make(chan []byte), wake: make(chan bool, 1), size: size, limit: limit}
+}
+
+// droppedStream returns a stream that ignores its parts, for a reply
+// that was refused when it started
+func droppedStream() *replyStream {
+	return &replyStream{ended: true}
+}
+
+func (s *replyStream) signal() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// push queues part of the reply for External without blocking. Returns
+// an error if the reply grows past its limit, or the backend sent more
+// than streamWindow ahead of the client
+func (s *replyStream) push(part []byte) *HubError {
+	if len(part) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ended {
+		return nil
+	}
+	s.size += int64(len(part))
+	if s.size > s.limit {
+		return responseTooLarge(int(s.size), s.limit)
+	}
+	if s.buffered > 0 && s.buffered+int64(len(part)) > streamWindow {
+		return errStreamOverflow
+	}
+	s.queued = append(s.queued, part)
+	s.buffered += int64(len(part))
+	s.signal()
+	return nil
+}
+
+// abort ends the stream with err, dropping the parts not yet taken
+// and any sent later
+func (s *replyStream) abort(err *HubError) {
+	s.lock.Lock()
+	if !s.ended {
+		s.ended = true
+		s.err = err
+		s.queued = nil
+		s.buffered = 0
+	}
+	s.lock.Unlock()
+	s.signal()
+}
+
+// end closes the stream once External has taken the queued parts
+func (s *replyStream) end() {
+	s.lock.Lock()
+	s.ended = true
+	s.lock.Unlock()
+	s.signal()
+}
+
+// forward hands the queued parts to External, returning credit for
+// each. A client that takes none for streamStall is cut off
+func (s *replyStream) forward() {
+	stall := time.NewTimer(streamStall)
+	defer stall.Stop()
+	for {
+		s.lock.Lock()
+		if len(s.queued) == 0 {
+			ended := s.ended
+			s.lock.Unlock()
+			if ended {
+				close(s.parts)
+				return
+			}
+			<-s.wake
+			continue
+		}
+		part := s.queued[0]
+		s.queued[0] = nil
+		s.queued = s.queued[1:]
+		s.lock.Unlock()
+
+		if !stall.Stop() {
+			<-stall.C
+		}
+		stall.Reset(streamStall)
+		select {
+		case s.parts <- part:
+		case <-stall.C:
+			stall.Reset(streamStall)
+			s.abort(errStreamStalled)
+			if s.notify != nil {
+				s.notify(cancelFrame(s.id, errStreamStalled))
+			}
+			continue
+		}
+
+		s.lock.Lock()
+		s.buffered -= int64(len(part))
+		s.lock.Unlock()
+		if s.notify != nil {
+			s.notify(&Frame{Op: OpCredit, Headers: map[string][]string{
+				"X-Hub-Id":     {s.id},
+				"X-Hub-Credit": {strconv.Itoa(len(part))},
+			}})
+		}
+	}
+}
+
+// cancelFrame tells a backend to stop sending the streamed reply id
+func cancelFrame(id string, e *HubError) *Frame {
+	headers := e.Headers()
+	headers["X-Hub-Id"] = []string{id}
+	return &Frame{Op: OpCancel, Headers: headers}
+}
+
+// startCall handles a client call in the background. The result is
+// sent to results unless the connection is closed first
+func (me *Internal) startCall(f *Frame, remoteAddr string, results chan<- *Frame, quit <-chan bool) {
+	go func() {
+		var result *Frame
+		if me.External == nil {
+			e := newError(501, CodeBadRequest, "calls are not enabled on this hub")
+			result = resultFrame(firstHeader(f.Headers, "X-Hub-Call-Id"), "", errorResponse(e))
+		} else {
+			result = me.External.call(f, remoteAddr)
+		}
+		select {
+		case results <- result:
+		case <-quit:
+		}
+	}()
+}
+
+// responseLimit returns the largest reply body accepted for req
+func (me *Internal) responseLimit(req *Request) int64 {
+	limit := me.MaxMessageSize
+	if limit <= 0 {
+		limit = maxMessageSize
+	}
+	if req.MaxResponseSize > 0 && req.MaxResponseSize < limit {
+		limit = req.MaxResponseSize
+	}
+	return limit
+}
+
+// upgrader accepts backend connections, negotiating the frame
+// format and compression
+func (me *Internal) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    2048,
+		WriteBufferSize:   2048,
+		Subprotocols:      Subprotocols,
+		EnableCompression: me.Compression.Deflate,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+	}
+}
+
 func parseQueues(uri string) []string {
 	if uri == "" {
 		return []string{}
@@ -0,0 +1,358 @@
+package retinaws
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type HubSuite struct{}
+
+var _ = Suite(&HubSuite{})
+
+// startHub serves backend connections to internal, returning the
+// websocket URL and a function to stop the server
+func startHub(internal *Internal) (string, func()) {
+	server := httptest.NewServer(internal)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/", func() {
+		internal.Router.Destroy()
+		server.Close()
+	}
+}
+
+// dialRaw connects a websocket backend to queue that does not run
+// the usual frame handling. pinged is called for each hub ping; the
+// pong is only sent if it returns true
+func dialRaw(c *C, url string, pinged func() bool, frames *int32) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	c.Assert(err, IsNil)
+	ws.SetPingHandler(func(data string) error {
+		if pinged() {
+			return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+			atomic.AddInt32(frames, 1)
+		}
+	}()
+	return ws
+}
+
+func (s *HubSuite) TestHeartbeatInterval(c *C) {
+	url, stop := startHub(&Internal{Router: NewRouter(), Heartbeat: Heartbeat{Interval: 50 * time.Millisecond}})
+	defer stop()
+
+	var pings, frames int32
+	ws := dialRaw(c, url+"beat", func() bool {
+		atomic.AddInt32(&pings, 1)
+		return true
+	}, &frames)
+	defer ws.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	n := atomic.LoadInt32(&pings)
+	c.Check(n >= 7 && n <= 11, Equals, true, Commentf("%d pings in 500ms", n))
+}
+
+func (s *HubSuite) TestSuspectBackendSkipped(c *C) {
+	internal := &Internal{
+		Router:    NewRouter(),
+		Heartbeat: Heartbeat{Interval: 100 * time.Millisecond, Timeout: 5 * time.Second},
+	}
+	internal.Router.Configure("pinned", QueueConfig{Affinity: AffinityKey{Header: "X-User"}})
+	url, stop := startHub(internal)
+	defer stop()
+
+	// a backend that stops answering pings, but stays connected
+	var silentFrames int32
+	silent := dialRaw(c, url+"pinned", func() bool { return false }, &silentFrames)
+	defer silent.Close()
+
+	healthy := &Backend{
+		URL:       url + "pinned",
+		Workers:   4,
+		Heartbeat: Heartbeat{Interval: 100 * time.Millisecond, Timeout: 5 * time.Second},
+		Handler: func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			return nil, []byte("healthy")
+		},
+	}
+	done := make(chan bool)
+	defer close(done)
+	go healthy.Serve(done)
+
+	// suspect after one missed heartbeat, well before the timeout
+	time.Sleep(500 * time.Millisecond)
+	internal.Router.lock.Lock()
+	health := make([]bool, 0)
+	for _, consumer := range internal.Router.byQueue["pinned"].consumers {
+		health = append(health, consumer.healthy)
+	}
+	internal.Router.lock.Unlock()
+	c.Assert(health, HasLen, 2)
+	c.Check(health[0] != health[1], Equals, true)
+
+	// so neither dispatch nor affinity picks it
+	route := &Route{External: &External{Router: internal.Router, Timeout: 2 * time.Second}, Queue: "pinned"}
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("POST", "/pinned", strings.NewReader("hi"))
+		req.Header.Set("X-User", "user"+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, req)
+		c.Check(w.Code, Equals, 200)
+		c.Check(w.Body.String(), Equals, "healthy")
+	}
+	c.Check(atomic.LoadInt32(&silentFrames), Equals, int32(0))
+}
+
+func (s *HubSuite) TestBodyLimitLoweredToMessageSize(c *C) {
+	internal := &Internal{Router: NewRouter(), MaxMessageSize: 1024}
+	internal.Router.MaxMessageSize = 1024
+	internal.Router.Configure("big", QueueConfig{MaxBodySize: 1 << 20})
+	c.Check(internal.Router.Config("big").bodyLimit(), Equals, int64(1024))
+	url, stop := startHub(internal)
+	defer stop()
+
+	b := &Backend{
+		URL:     url + "big",
+		Workers: 2,
+		Handler: func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			return nil, body
+		},
+	}
+	done := make(chan bool)
+	defer close(done)
+	go b.Serve(done)
+	time.Sleep(100 * time.Millisecond)
+
+	// too large for the connection, so rejected before dispatch rather
+	// than dropping the backend
+	route := &Route{External: &External{Router: internal.Router, Timeout: 2 * time.Second}, Queue: "big"}
+	for _, size := range []int{512, 2000, 512} {
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, httptest.NewRequest("POST", "/big", strings.NewReader(strings.Repeat("x", size))))
+		if size > 1024 {
+			c.Check(w.Code, Equals, 413)
+		} else {
+			c.Check(w.Code, Equals, 200)
+			c.Check(w.Body.Len(), Equals, size)
+		}
+	}
+}
+
+func (s *HubSuite) TestReplyStreamLimits(c *C) {
+	stream := newReplyStream("1", 100, 1000)
+	c.Check(stream.push(make([]byte, 800)), IsNil)
+	c.Check(stream.push(nil), IsNil)
+	err := stream.push(make([]byte, 200))
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, CodeResponseTooLarge)
+
+	// a backend sending more than streamWindow ahead of the client
+	stream = newReplyStream("2", 0, 64<<20)
+	go stream.forward()
+	part := make([]byte, streamWindow/4)
+	for i := 0; i < 4; i++ {
+		c.Assert(stream.push(part), IsNil)
+	}
+	resp := &Response{Body: []byte("head"), Stream: stream.parts, stream: stream}
+	c.Check(stream.push(part), Equals, errStreamOverflow)
+	stream.abort(errStreamOverflow)
+	c.Check(stream.push(part), IsNil)
+
+	// which the reader sees once it has read the part in flight
+	resp.readAll()
+	c.Check(resp.Error, Equals, errStreamOverflow)
+	c.Check(resp.HTTPStatus, Equals, 504)
+}
+
+func (s *HubSuite) TestReplyStreamCredit(c *C) {
+	credits := make(chan *Frame, 2)
+	stream := newReplyStream("7", 0, 1000)
+	stream.notify = func(f *Frame) { credits <- f }
+	go stream.forward()
+	c.Assert(stream.push([]byte("abc")), IsNil)
+	c.Assert(stream.push([]byte("de")), IsNil)
+	stream.end()
+
+	// credit is returned for each part as the client takes it
+	c.Check(string(<-stream.parts), Equals, "abc")
+	f := <-credits
+	c.Check(f.Op, Equals, OpCredit)
+	c.Check(firstHeader(f.Headers, "X-Hub-Id"), Equals, "7")
+	c.Check(firstHeader(f.Headers, "X-Hub-Credit"), Equals, "3")
+	c.Check(string(<-stream.parts), Equals, "de")
+	c.Check(firstHeader((<-credits).Headers, "X-Hub-Credit"), Equals, "2")
+	_, ok := <-stream.parts
+	c.Check(ok, Equals, false)
+}
+
+// startStreaming connects a backend to queues that streams parts of
+// size bytes for requests to /stream/<parts>, and replies at once
+// otherwise. The result of each stream is sent to errs
+func startStreaming(url string, size int, errs chan error) chan bool {
+	b := &Backend{URL: url, Workers: 4}
+	b.Handler = func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		var parts int
+		if _, err := fmt.Sscanf(firstHeader(headers, "X-Hub-Uri"), "/stream/%d", &parts); err != nil {
+			return nil, []byte("done")
+		}
+		stream, err := b.Stream(headers, 200, nil)
+		if err != nil {
+			errs <- err
+			return nil, nil
+		}
+		part := bytes.Repeat([]byte("x"), size)
+		for i := 0; i < parts && err == nil; i++ {
+			_, err = stream.Write(part)
+		}
+		errs <- err
+		return nil, nil
+	}
+	done := make(chan bool)
+	go b.Serve(done)
+	time.Sleep(100 * time.Millisecond)
+	return done
+}
+
+func (s *HubSuite) TestSlowStreamReader(c *C) {
+	internal := &Internal{Router: NewRouter(), MaxMessageSize: 64 << 20}
+	internal.Router.MaxMessageSize = 64 << 20
+	internal.Router.Defaults = QueueConfig{MaxResponseSize: 64 << 20}
+	url, stop := startHub(internal)
+	defer stop()
+	errs := make(chan error, 1)
+	done := startStreaming(url+"slow,fast", 128<<10, errs)
+	defer close(done)
+
+	external := &External{Router: internal.Router, Timeout: 10 * time.Second}
+	server := httptest.NewServer(&Route{External: external, Queue: "slow"})
+	defer server.Close()
+	fast := &Route{External: external, Queue: "fast"}
+
+	// a client that stops reading a 32 MiB reply
+	resp, err := http.Get(server.URL + "/stream/256")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, 200)
+	time.Sleep(300 * time.Millisecond)
+
+	// does not hold up other requests on the connection
+	start := time.Now()
+	w := httptest.NewRecorder()
+	fast.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	c.Check(w.Body.String(), Equals, "done")
+	c.Check(time.Since(start) < time.Second, Equals, true, Commentf("took %v", time.Since(start)))
+
+	// holds up the backend instead
+	select {
+	case err := <-errs:
+		c.Fatalf("backend finished streaming to a stalled client: %v", err)
+	default:
+	}
+
+	// and gets the whole reply once it reads again
+	n, err := io.Copy(io.Discard, resp.Body)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, int64(32<<20))
+	select {
+	case err := <-errs:
+		c.Check(err, IsNil)
+	case <-time.After(10 * time.Second):
+		c.Fatal("backend did not finish streaming")
+	}
+}
+
+func (s *HubSuite) TestStreamedReplyLimit(c *C) {
+	internal := &Internal{Router: NewRouter()}
+	internal.Router.Configure("capped", QueueConfig{MaxResponseSize: 1000})
+	url, stop := startHub(internal)
+	defer stop()
+	errs := make(chan error, 2)
+	done := startStreaming(url+"capped", 400, errs)
+	defer close(done)
+
+	external := &External{Router: internal.Router, Timeout: 2 * time.Second}
+	server := httptest.NewServer(&Route{External: external, Queue: "capped"})
+	defer server.Close()
+
+	// two parts fit
+	resp, err := http.Get(server.URL + "/stream/2")
+	c.Assert(err, IsNil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, IsNil)
+	c.Check(body, HasLen, 800)
+	c.Check(<-errs, IsNil)
+
+	// the third is refused by the backend and the reply is cut off
+	resp, err = http.Get(server.URL + "/stream/3")
+	c.Assert(err, IsNil)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, NotNil)
+	c.Check(len(body) <= 800, Equals, true)
+	select {
+	case err := <-errs:
+		e, ok := err.(*HubError)
+		c.Assert(ok, Equals, true)
+		c.Check(e.Code, Equals, CodeResponseTooLarge)
+	case <-time.After(time.Second):
+		c.Error("stream write did not fail")
+	}
+
+	// and reported as an error to callers that read the whole reply
+	r := &Request{
+		Queue:           "capped",
+		Headers:         map[string][]string{"X-Hub-Uri": {"/stream/3"}},
+		MaxResponseSize: 1000,
+		Ack:             make(chan bool, 1),
+		ReplyTo:         make(chan *Response, 1),
+		Deadline:        time.Now().Add(time.Second),
+	}
+	reply := external.send(r, internal.Router.Config("capped"))
+	reply.readAll()
+	c.Assert(reply.Error, NotNil)
+	c.Check(reply.Error.Code, Equals, CodeResponseTooLarge)
+}
+
+func (s *HubSuite) TestQueuedTasksDroppedOnDisconnect(c *C) {
+	release := make(chan bool)
+	ran := make(chan string, 3)
+	pool := newWorkerPool(PoolConfig{MaxWorkers: 1}, 1, func(t *internalMessage) bool {
+		ran <- t.id[0]
+		<-release
+		return false
+	})
+	for _, id := range []string{"1", "2", "3"} {
+		c.Assert(pool.submit(&internalMessage{id: []string{id}}), Equals, true)
+	}
+	c.Check(<-ran, Equals, "1")
+	c.Check(pool.discard(), Equals, 2)
+	close(release)
+	pool.close()
+	c.Check(ran, HasLen, 0)
+	c.Check(pool.snapshot().Completed, Equals, 1)
+
+	// a reply to a closed connection is dropped rather than blocking
+	writerDone := make(chan bool)
+	close(writerDone)
+	handler := func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		return nil, body
+	}
+	msg := &internalMessage{id: []string{"4"}, headers: map[string][]string{}, body: []byte("x")}
+	b := &Backend{}
+	c.Check(b.runTask(handler, frameEncoder{codec: FrameV2}, msg, make(chan *Message), writerDone), Equals, false)
+}
@@ -0,0 +1,176 @@
+package retinaws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// JSON-RPC 2.0 error codes, see https://www.jsonrpc.org/specification
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+
+	// Application errors, such as a *HubError returned by a method
+	RPCServerError = -32000
+)
+
+// RPCRequest is a JSON-RPC 2.0 request. ID is absent for notifications,
+// which get no response
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+func (r *RPCRequest) IsNotification() bool {
+	return r.ID == nil
+}
+
+// RPCResponse is a JSON-RPC 2.0 response
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// RPCError is a JSON-RPC 2.0 error. Methods may return one to choose
+// the code sent to the client
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPCMethod handles a JSON-RPC method call, returning its result.
+// ctx ends at the hub deadline and carries the hub headers, see
+// RequestHeaders
+type RPCMethod func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// RPCFunc adapts fn to an RPCMethod that decodes params into Req. As
+// with JSONHandler, Req may implement Validator. Undecodable or
+// invalid params are an RPCInvalidParams error
+func RPCFunc[Req, Resp any](fn func(ctx context.Context, req Req) (Resp, error)) RPCMethod {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		req, err := decodeJSON[Req](params)
+		if err != nil {
+			return nil, &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+		}
+		return fn(ctx, req)
+	}
+}
+
+// JSONRPC returns a MessageHandler serving JSON-RPC 2.0 requests and
+// batches with methods. Responses are sent with status 200, or 204
+// if every request was a notification. Errors returned by a method
+// are sent as follows:
+//
+//	*RPCError          as is
+//	*HubError          RPCServerError, with data {"code": ..., "status": ...}
+//	deadline passed    RPCServerError, with data {"code": "timeout"}
+//	other              RPCInternalError
+func JSONRPC(methods map[string]RPCMethod) MessageHandler {
+	return func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		if e := negotiateJSON(headers); e != nil {
+			return e.Headers(), nil
+		}
+
+		var reply interface{}
+		body = bytes.TrimSpace(body)
+		if !json.Valid(body) {
+			reply = rpcErrorResponse(nil, &RPCError{Code: RPCParseError, Message: "parse error"})
+		} else if body[0] == '[' {
+			var batch []json.RawMessage
+			json.Unmarshal(body, &batch)
+			if len(batch) == 0 {
+				reply = rpcErrorResponse(nil, &RPCError{Code: RPCInvalidRequest, Message: "empty batch"})
+			} else {
+				responses := make([]*RPCResponse, 0, len(batch))
+				for _, raw := range batch {
+					if resp := serveRPC(methods, headers, raw); resp != nil {
+						responses = append(responses, resp)
+					}
+				}
+				if len(responses) > 0 {
+					reply = responses
+				}
+			}
+		} else if resp := serveRPC(methods, headers, body); resp != nil {
+			reply = resp
+		}
+
+		if reply == nil {
+			return map[string][]string{"X-Hub-Status": []string{"204"}}, nil
+		}
+		data, _ := json.Marshal(reply)
+		return map[string][]string{
+			"X-Hub-Status": []string{"200"},
+			"Content-Type": []string{"application/json"},
+		}, data
+	}
+}
+
+// serveRPC calls the method for one request. Returns nil for notifications
+func serveRPC(methods map[string]RPCMethod, headers map[string][]string, raw json.RawMessage) *RPCResponse {
+	var req RPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcErrorResponse(req.ID, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"})
+	}
+
+	method, ok := methods[req.Method]
+	if !ok {
+		if req.IsNotification() {
+			return nil
+		}
+		return rpcErrorResponse(req.ID, &RPCError{Code: RPCMethodNotFound, Message: "method not found: " + req.Method})
+	}
+
+	ctx, cancel := handlerContext(headers)
+	defer cancel()
+	result, err := method(ctx, req.Params)
+	if req.IsNotification() {
+		return nil
+	}
+	if err != nil {
+		return rpcErrorResponse(req.ID, rpcError(ctx, err))
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return rpcErrorResponse(req.ID, &RPCError{Code: RPCInternalError, Message: "cannot encode result: " + err.Error()})
+	}
+	return &RPCResponse{JSONRPC: "2.0", Result: data, ID: req.ID}
+}
+
+func rpcErrorResponse(id json.RawMessage, e *RPCError) *RPCResponse {
+	return &RPCResponse{JSONRPC: "2.0", Error: e, ID: id}
+}
+
+// rpcError returns the error response for an error from a method
+func rpcError(ctx context.Context, err error) *RPCError {
+	var re *RPCError
+	if errors.As(err, &re) {
+		return re
+	}
+	var he *HubError
+	if errors.As(err, &he) {
+		status := he.Status
+		if status == 0 {
+			status = 500
+		}
+		return &RPCError{Code: RPCServerError, Message: he.Message, Data: map[string]interface{}{"code": he.Code, "status": status}}
+	}
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+		return &RPCError{Code: RPCServerError, Message: err.Error(), Data: map[string]interface{}{"code": CodeTimeout}}
+	}
+	return &RPCError{Code: RPCInternalError, Message: err.Error()}
+}
@@ -0,0 +1,235 @@
+package retinaws
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a MessageHandler with behavior shared by many
+// handlers, such as logging or panic recovery
+type Middleware func(MessageHandler) MessageHandler
+
+// Chain composes middleware into one. The first runs outermost, so
+//
+//	Chain(Logger(nil), Recover())(h)
+//
+// logs every request, including the 500 replies for panics in h
+func Chain(mws ...Middleware) Middleware {
+	return func(h MessageHandler) MessageHandler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+// Wrap returns h wrapped in mws, the first outermost
+func Wrap(h MessageHandler, mws ...Middleware) MessageHandler {
+	return Chain(mws...)(h)
+}
+
+// replyStatus returns the HTTP status of a handler reply
+func replyStatus(reply map[string][]string) int {
+	if status, err := strconv.Atoi(firstHeader(reply, "X-Hub-Status")); err == nil {
+		return status
+	}
+	return 200
+}
+
+// Recover returns middleware that turns a panic in the handler into a
+// 500 internal_error reply and logs the panic and stack. Backend
+// recovers from panics in Handler as well; Recover lets the
+// middleware outside it, such as Logger, see the reply
+func Recover() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(headers map[string][]string, body []byte) (reply map[string][]string, replyBody []byte) {
+			defer func() {
+				if p := recover(); p != nil {
+					log.Printf("retinaws: handler panic: queue=%s request=%s: %v\n%s",
+						firstHeader(headers, "X-Hub-Queue"), firstHeader(headers, "X-Hub-Request-Id"), p, debug.Stack())
+					reply, replyBody = newError(500, CodeInternal, "handler panicked").Headers(), nil
+				}
+			}()
+			return next(headers, body)
+		}
+	}
+}
+
+// Logger returns middleware that logs each request with its queue,
+// method, URI, request ID, status, reply size and duration. Uses
+// slog.Default() if logger is nil
+func Logger(logger *slog.Logger) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			start := time.Now()
+			reply, replyBody := next(headers, body)
+
+			l := logger
+			if l == nil {
+				l = slog.Default()
+			}
+			attrs := []interface{}{
+				"queue", firstHeader(headers, "X-Hub-Queue"),
+				"method", firstHeader(headers, "X-Hub-Method"),
+				"uri", firstHeader(headers, "X-Hub-Uri"),
+				"request_id", firstHeader(headers, "X-Hub-Request-Id"),
+				"status", replyStatus(reply),
+				"bytes", len(replyBody),
+				"duration", time.Since(start),
+			}
+			if code := firstHeader(reply, "X-Hub-Error"); code != "" {
+				attrs = append(attrs, "error", code)
+			}
+			l.Info("request", attrs...)
+			return reply, replyBody
+		}
+	}
+}
+
+// Timeout returns middleware that replies with a 504 timeout error if
+// the handler takes longer than d. The handler sees the shortened
+// deadline in X-Hub-Deadline, so HTTPHandler contexts and nested calls
+// end with it, but is left to finish in the background. Its reply is
+// then discarded. Panics in the handler are passed on to the caller
+func Timeout(d time.Duration) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			headers = withDeadline(headers, time.Now().Add(d))
+
+			type result struct {
+				reply map[string][]string
+				body  []byte
+				panic interface{}
+			}
+			done := make(chan result, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						done <- result{panic: p}
+					}
+				}()
+				reply, replyBody := next(headers, body)
+				done <- result{reply: reply, body: replyBody}
+			}()
+
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case r := <-done:
+				if r.panic != nil {
+					panic(r.panic)
+				}
+				return r.reply, r.body
+			case <-timer.C:
+				go func() {
+					if r := <-done; r.panic != nil {
+						log.Println("retinaws: handler panic after timeout:", r.panic)
+					}
+				}()
+				return newError(504, CodeTimeout, fmt.Sprintf("handler timed out after %v", d)).Headers(), nil
+			}
+		}
+	}
+}
+
+// withDeadline returns a copy of headers with X-Hub-Deadline set to
+// deadline, unless the request's own deadline is earlier
+func withDeadline(headers map[string][]string, deadline time.Time) map[string][]string {
+	ms := deadline.UnixNano() / int64(time.Millisecond)
+	if cur, err := strconv.ParseInt(firstHeader(headers, "X-Hub-Deadline"), 10, 64); err == nil && cur < ms {
+		return headers
+	}
+	copied := make(map[string][]string, len(headers)+1)
+	for name, vals := range headers {
+		copied[name] = vals
+	}
+	copied["X-Hub-Deadline"] = []string{strconv.FormatInt(ms, 10)}
+	return copied
+}
+
+// LatencyStats summarizes the requests a handler served for a queue
+type LatencyStats struct {
+	Requests int
+
+	// Replies with a 5xx status or an X-Hub-Error code
+	Errors int
+
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// Mean returns the mean request latency
+func (s LatencyStats) Mean() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Requests)
+}
+
+// HandlerMetrics records handler latency by queue. Use Middleware to
+// record requests
+type HandlerMetrics struct {
+	lock  sync.Mutex
+	stats map[string]*LatencyStats
+}
+
+// Middleware returns middleware that records each request's latency
+func (m *HandlerMetrics) Middleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			start := time.Now()
+			reply, replyBody := next(headers, body)
+			failed := replyStatus(reply) >= 500 || firstHeader(reply, "X-Hub-Error") != ""
+			m.record(firstHeader(headers, "X-Hub-Queue"), time.Since(start), failed)
+			return reply, replyBody
+		}
+	}
+}
+
+func (m *HandlerMetrics) record(queue string, latency time.Duration, failed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stats == nil {
+		m.stats = make(map[string]*LatencyStats)
+	}
+	stats, ok := m.stats[queue]
+	if !ok {
+		stats = &LatencyStats{}
+		m.stats[queue] = stats
+	}
+	stats.Requests++
+	if failed {
+		stats.Errors++
+	}
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+}
+
+// Stats returns the stats recorded for queue
+func (m *HandlerMetrics) Stats(queue string) LatencyStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats, ok := m.stats[queue]
+	if !ok {
+		return LatencyStats{}
+	}
+	return *stats
+}
+
+// Snapshot returns the stats recorded for every queue
+func (m *HandlerMetrics) Snapshot() map[string]LatencyStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	snapshot := make(map[string]LatencyStats, len(m.stats))
+	for queue, stats := range m.stats {
+		snapshot[queue] = *stats
+	}
+	return snapshot
+}
@@ -0,0 +1,122 @@
+package retinaws
+
+import (
+	"log"
+	"time"
+)
+
+// MirrorStats compares a queue's responses with those of its shadow queue
+type MirrorStats struct {
+	// Requests copied to the shadow queue and completed
+	Requests int
+
+	// Requests where the shadow status differed from the primary
+	StatusDiffs int
+
+	// Total latency of primary and shadow requests
+	PrimaryLatency time.Duration
+	ShadowLatency  time.Duration
+}
+
+// LatencyDiff returns the mean amount the shadow queue was slower
+// than the primary. Negative if the shadow was faster
+func (s MirrorStats) LatencyDiff() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return (s.ShadowLatency - s.PrimaryLatency) / time.Duration(s.Requests)
+}
+
+type mirrorResult struct {
+	status  int
+	latency time.Duration
+}
+
+func resultOf(resp *Response, start time.Time) mirrorResult {
+	status := resp.HTTPStatus
+	if status == 0 {
+		status = 200
+	}
+	return mirrorResult{status: status, latency: time.Since(start)}
+}
+
+// startMirror sends a copy of req to the queue's shadow queue. The
+// primary result must be sent on the returned channel so the two
+// can be compared. Returns nil if the queue is not mirrored
+func (me *External) startMirror(req *Request, conf QueueConfig) chan<- mirrorResult {
+	if conf.Mirror == "" {
+		return nil
+	}
+
+	shadowConf := me.Router.Config(conf.Mirror)
+	shadow := req.shadow(conf.Mirror, time.Now().Add(me.timeout(shadowConf)))
+	primary := make(chan mirrorResult, 1)
+	go func() {
+		start := time.Now()
+		resp := me.send(shadow, shadowConf)
+		resp.readAll()
+		s := resultOf(resp, start)
+		me.recordMirror(req.Queue, <-primary, s)
+	}()
+	return primary
+}
+
+func (me *External) recordMirror(queue string, primary, shadow mirrorResult) {
+	if primary.status != shadow.status {
+		log.Printf("retinaws: mirror status differs on queue: %s primary=%d shadow=%d",
+			queue, primary.status, shadow.status)
+	}
+
+	me.mirrorLock.Lock()
+	defer me.mirrorLock.Unlock()
+
+	if me.mirrorStats == nil {
+		me.mirrorStats = make(map[string]*MirrorStats)
+	}
+	stats, ok := me.mirrorStats[queue]
+	if !ok {
+		stats = &MirrorStats{}
+		me.mirrorStats[queue] = stats
+	}
+	stats.Requests++
+	if primary.status != shadow.status {
+		stats.StatusDiffs++
+	}
+	stats.PrimaryLatency += primary.latency
+	stats.ShadowLatency += shadow.latency
+}
+
+// MirrorStats returns the comparison of queue with its shadow queue
+func (me *External) MirrorStats(queue string) MirrorStats {
+	me.mirrorLock.Lock()
+	defer me.mirrorLock.Unlock()
+
+	stats, ok := me.mirrorStats[queue]
+	if !ok {
+		return MirrorStats{}
+	}
+	return *stats
+}
+
+// AllMirrorStats returns the comparisons of all mirrored queues
+// that have completed requests, keyed by queue
+func (me *External) AllMirrorStats() map[string]MirrorStats {
+	me.mirrorLock.Lock()
+	defer me.mirrorLock.Unlock()
+
+	all := make(map[string]MirrorStats, len(me.mirrorStats))
+	for queue, stats := range me.mirrorStats {
+		all[queue] = *stats
+	}
+	return all
+}
+
+// shadow returns a copy of the request for the given shadow queue.
+// Headers are copied since the hub adds its own to each request
+func (me *Request) shadow(queue string, deadline time.Time) *Request {
+	r := me.retry(deadline)
+	r.Queue = queue
+	r.Headers = copyHeaders(me.Headers)
+	r.Headers["X-Hub-Mirror-Of"] = []string{me.Queue}
+	return r
+}
@@ -0,0 +1,75 @@
+package retinaws
+
+import (
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type MirrorSuite struct{}
+
+var _ = Suite(&MirrorSuite{})
+
+func (s *MirrorSuite) TestMirrorToShadowQueue(c *C) {
+	internal := &Internal{Router: NewRouter()}
+	internal.Router.Configure("primary", QueueConfig{Mirror: "shadow"})
+	url, stop := startHub(internal)
+	defer stop()
+
+	// the shadow build fails requests the primary handles
+	var copies int32
+	b := &Backend{
+		URL:     url + "primary,shadow",
+		Workers: 4,
+		Handler: func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+			if firstHeader(headers, "X-Hub-Queue") == "primary" {
+				return nil, append([]byte("primary:"), body...)
+			}
+			if firstHeader(headers, "X-Hub-Mirror-Of") == "primary" {
+				atomic.AddInt32(&copies, 1)
+			}
+			if string(body) == "broken" {
+				return map[string][]string{"X-Hub-Status": []string{"500"}}, nil
+			}
+			return nil, append([]byte("shadow:"), body...)
+		},
+	}
+	done := make(chan bool)
+	defer close(done)
+	go b.Serve(done)
+	time.Sleep(100 * time.Millisecond)
+
+	external := &External{Router: internal.Router, Timeout: 2 * time.Second}
+	route := &Route{External: external, Queue: "primary"}
+	for _, body := range []string{"ok", "broken", "ok"} {
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, httptest.NewRequest("POST", "/primary", strings.NewReader(body)))
+		c.Check(w.Code, Equals, 200)
+		c.Check(w.Body.String(), Equals, "primary:"+body)
+	}
+
+	for i := 0; i < 40 && external.MirrorStats("primary").Requests < 3; i++ {
+		time.Sleep(25 * time.Millisecond)
+	}
+	c.Check(atomic.LoadInt32(&copies), Equals, int32(3))
+	stats := external.MirrorStats("primary")
+	c.Check(stats.Requests, Equals, 3)
+	c.Check(stats.StatusDiffs, Equals, 1)
+
+	// and served by the admin API
+	w := httptest.NewRecorder()
+	NewAdmin(map[string]*External{"hub": external}).ServeHTTP(w, httptest.NewRequest("GET", "/hubs/hub/mirrors", nil))
+	c.Check(w.Code, Equals, 200)
+	var body struct {
+		Queues map[string]struct {
+			Requests    int `json:"requests"`
+			StatusDiffs int `json:"status_diffs"`
+		}
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &body), IsNil)
+	c.Check(body.Queues["primary"].Requests, Equals, 3)
+	c.Check(body.Queues["primary"].StatusDiffs, Equals, 1)
+}
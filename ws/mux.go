@@ -0,0 +1,136 @@
+package retinaws
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// QueueMux dispatches requests to handlers by queue and, optionally,
+// by HTTP method and URI path. Requests no handler matches get a 404
+// or 405 error reply. To serve the registered queues:
+//
+//	b := &Backend{URL: mux.URL("ws://localhost:9391/"), Handler: mux.ServeMessage}
+type QueueMux struct {
+	lock sync.RWMutex
+
+	// routes keyed by queue name or pattern, in registration order
+	routes map[string][]muxRoute
+}
+
+type muxRoute struct {
+	method  string
+	path    string
+	handler MessageHandler
+}
+
+func NewQueueMux() *QueueMux {
+	return &QueueMux{routes: make(map[string][]muxRoute)}
+}
+
+// Handle registers handler for all requests to queue. queue may be a
+// glob pattern (see path.Match), used if no queue name matches exactly
+func (m *QueueMux) Handle(queue string, handler MessageHandler) {
+	m.HandleRoute(queue, "", "", handler)
+}
+
+// HandleRoute registers handler for requests to queue with the given
+// HTTP method and URI path. The path may be a glob pattern such as
+// /users/*. An empty method or path matches any. Routes are tried in
+// the order they were registered
+func (m *QueueMux) HandleRoute(queue, method, pattern string, handler MessageHandler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.routes[queue] = append(m.routes[queue], muxRoute{
+		method:  strings.ToUpper(method),
+		path:    pattern,
+		handler: handler,
+	})
+}
+
+// Queues returns the registered queue names and patterns, sorted
+func (m *QueueMux) Queues() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	queues := make([]string, 0, len(m.routes))
+	for queue := range m.routes {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+// URL returns the URL a Backend dials to subscribe to the registered
+// queues on the hub at hubURL, e.g. ws://localhost:9391/
+func (m *QueueMux) URL(hubURL string) string {
+	queues := m.Queues()
+	for i, queue := range queues {
+		queues[i] = strings.Replace(queue, "?", "%3F", -1)
+	}
+	if !strings.HasSuffix(hubURL, "/") {
+		hubURL += "/"
+	}
+	return hubURL + strings.Join(queues, ",")
+}
+
+// ServeMessage is a MessageHandler that calls the handler registered
+// for the request
+func (m *QueueMux) ServeMessage(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+	queue := firstHeader(headers, "X-Hub-Queue")
+	routes := m.match(queue)
+	if len(routes) == 0 {
+		return newError(404, CodeNotFound, "no handler for queue: "+queue).Headers(), nil
+	}
+
+	uri := firstHeader(headers, "X-Hub-Uri")
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		uri = u.Path
+	}
+	method := firstHeader(headers, "X-Hub-Method")
+
+	allowed := make([]string, 0)
+	for _, route := range routes {
+		if route.path != "" {
+			if ok, _ := path.Match(route.path, uri); !ok {
+				continue
+			}
+		}
+		if route.method == "" || route.method == method {
+			return route.handler(headers, body)
+		}
+		allowed = append(allowed, route.method)
+	}
+
+	if len(allowed) == 0 {
+		return newError(404, CodeNotFound, "no handler for path: "+uri).Headers(), nil
+	}
+	reply := newError(405, CodeMethodNotAllowed, "method not allowed: "+method).Headers()
+	reply["Allow"] = []string{strings.Join(allowed, ", ")}
+	return reply, nil
+}
+
+// match returns the routes for queue, falling back to the first
+// matching pattern in sorted order
+func (m *QueueMux) match(queue string) []muxRoute {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if routes, ok := m.routes[queue]; ok {
+		return routes
+	}
+
+	patterns := make([]string, 0)
+	for pattern := range m.routes {
+		if isPattern(pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, queue); ok {
+			return m.routes[pattern]
+		}
+	}
+	return nil
+}
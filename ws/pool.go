@@ -0,0 +1,189 @@
+package retinaws
+
+import (
+	"sync"
+	"time"
+)
+
+// PoolConfig sizes the worker pool that runs a Backend's Handler.
+// The pool grows from MinWorkers to MaxWorkers while requests are
+// waiting and shrinks again once workers have been idle
+type PoolConfig struct {
+	// Workers kept running while idle. 0 = Backend.Workers, or 1
+	MinWorkers int
+
+	// Most workers run at once. 0 = 256, or MinWorkers if larger
+	MaxWorkers int
+
+	// Time a worker above MinWorkers waits for a request before
+	// exiting. 0 = 30 seconds
+	IdleTimeout time.Duration
+
+	// Requests held while MaxWorkers are busy. Requests beyond this
+	// get a 503 overloaded reply. 0 = 1024
+	QueueSize int
+}
+
+const (
+	defaultMaxWorkers  = 256
+	defaultIdleTimeout = 30 * time.Second
+	defaultPoolQueue   = 1024
+)
+
+// PoolStats describes a Backend's worker pool
+type PoolStats struct {
+	// Workers running, and those running a request
+	Workers int
+	Busy    int
+
+	// Requests waiting for a worker
+	Queued int
+
+	// Totals for the current hub connection
+	Completed int
+	Panics    int
+	Rejected  int
+}
+
+// workerPool runs tasks on an elastic set of goroutines
+type workerPool struct {
+	conf PoolConfig
+
+	// run handles a task, returning true if the handler panicked
+	run   func(*internalMessage) bool
+	tasks chan *internalMessage
+	wg    sync.WaitGroup
+
+	lock  sync.Mutex
+	stats PoolStats
+
+	// tasks submitted and not yet finished
+	active int
+}
+
+// newWorkerPool starts a pool with conf's minimum workers. workers is
+// the Backend's Workers setting
+func newWorkerPool(conf PoolConfig, workers int, run func(*internalMessage) bool) *workerPool {
+	if conf.MinWorkers < 1 {
+		conf.MinWorkers = workers
+	}
+	if conf.MinWorkers < 1 {
+		conf.MinWorkers = 1
+	}
+	if conf.MaxWorkers < 1 {
+		conf.MaxWorkers = defaultMaxWorkers
+	}
+	if conf.MaxWorkers < conf.MinWorkers {
+		conf.MaxWorkers = conf.MinWorkers
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = defaultIdleTimeout
+	}
+	if conf.QueueSize < 1 {
+		conf.QueueSize = defaultPoolQueue
+	}
+
+	p := &workerPool{conf: conf, run: run, tasks: make(chan *internalMessage, conf.QueueSize)}
+	p.lock.Lock()
+	for i := 0; i < conf.MinWorkers; i++ {
+		p.startWorker()
+	}
+	p.lock.Unlock()
+	return p
+}
+
+// submit queues a task, starting another worker if none is free.
+// Returns false if the queue is full
+func (p *workerPool) submit(t *internalMessage) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.active >= p.stats.Workers && p.stats.Workers < p.conf.MaxWorkers {
+		p.startWorker()
+	}
+	select {
+	case p.tasks <- t:
+		p.active++
+		return true
+	default:
+		p.stats.Rejected++
+		return false
+	}
+}
+
+// startWorker must be called with lock held
+func (p *workerPool) startWorker() {
+	p.stats.Workers++
+	p.wg.Add(1)
+	go p.worker()
+}
+
+func (p *workerPool) worker() {
+	defer p.wg.Done()
+	idle := time.NewTimer(p.conf.IdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case t, ok := <-p.tasks:
+			if !ok {
+				p.lock.Lock()
+				p.stats.Workers--
+				p.lock.Unlock()
+				return
+			}
+			p.lock.Lock()
+			p.stats.Busy++
+			p.lock.Unlock()
+
+			panicked := p.run(t)
+
+			p.lock.Lock()
+			p.stats.Busy--
+			p.stats.Completed++
+			p.active--
+			if panicked {
+				p.stats.Panics++
+			}
+			p.lock.Unlock()
+			idle.Reset(p.conf.IdleTimeout)
+		case <-idle.C:
+			p.lock.Lock()
+			if p.stats.Workers > p.conf.MinWorkers {
+				p.stats.Workers--
+				p.lock.Unlock()
+				return
+			}
+			p.lock.Unlock()
+			idle.Reset(p.conf.IdleTimeout)
+		}
+	}
+}
+
+// discard drops the queued tasks, returning how many there were
+func (p *workerPool) discard() int {
+	n := 0
+	for {
+		select {
+		case <-p.tasks:
+			n++
+		default:
+			p.lock.Lock()
+			p.active -= n
+			p.lock.Unlock()
+			return n
+		}
+	}
+}
+
+// close runs the queued tasks and waits for the workers to exit
+func (p *workerPool) close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
+
+func (p *workerPool) snapshot() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := p.stats
+	stats.Queued = len(p.tasks)
+	return stats
+}
@@ -0,0 +1,445 @@
+package retinaws
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+// QueueLimits bounds the amount of work that may wait on a queue.
+// Requests that would exceed the limits are rejected with a 503
+// instead of piling up in Router.deliver until their deadline.
+type QueueLimits struct {
+	// Maximum number of requests waiting for a backend. 0 = unlimited.
+	// Dispatch scans the waiting requests, so this also bounds its cost
+	MaxPending int
+
+	// Maximum time a request may wait for a backend to accept it.
+	// 0 = wait until the request deadline
+	MaxWait time.Duration
+
+	// CoDel style shedding. If the queueing delay stays above
+	// CodelTarget for CodelInterval, new requests are rejected until
+	// the delay drops below target again. 0 = disabled
+	CodelTarget   time.Duration
+	CodelInterval time.Duration
+
+	// How long a queue may have no backends before requests are
+	// rejected. Lets backends restart without shedding traffic
+	NoBackendGrace time.Duration
+
+	// Value of the Retry-After header (seconds) sent with a 503
+	RetryAfter int
+}
+
+// RetryPolicy controls how often a request is re-sent after the
+// backend replies with a 5xx status or the request times out
+type RetryPolicy struct {
+	// Number of retries after the first attempt. 0 = never retry
+	Retries int
+
+	// Delay before the first retry. Doubled on each further retry
+	Backoff time.Duration
+}
+
+// delay returns how long to wait before the given retry (1 based)
+func (p RetryPolicy) delay(retry int) time.Duration {
+	return p.Backoff << uint(retry-1)
+}
+
+// QueueConfig holds the per-queue settings applied by External and Router
+type QueueConfig struct {
+	QueueLimits
+
+	// Time a request may take, including retries. 0 = External.Timeout
+	Timeout time.Duration
+
+	// Largest request body accepted. Larger requests are rejected
+	// with a 413 before dispatch. 0 = 4 MiB
+	MaxBodySize int64
+
+	// Largest reply body accepted from a backend. Larger replies fail
+	// with a 502 without affecting other requests. 0 = 4 MiB
+	MaxResponseSize int64
+
+	// HTTP methods accepted on the queue. Empty = all methods
+	Methods []string
+
+	Retry RetryPolicy
+
+	// Reply 202 Accepted right away and process the request in the
+	// background. Backend responses are discarded
+	Async bool
+
+	// With Async, keep requests in External.Durable until a backend
+	// has handled them, so they are not lost if the hub restarts
+	Durable bool
+
+	// Keep requests that still fail once their retries run out in
+	// External.DeadLetters, for inspection and replay
+	DeadLetter bool
+
+	// A waiting request gains one priority level per PriorityAging
+	// so low priority work is not starved. 0 = defaultPriorityAging
+	PriorityAging time.Duration
+
+	// Pins requests with the same key to the same backend connection
+	Affinity AffinityKey
+
+	// Divides traffic between backend versions
+	Split TrafficSplit
+
+	// Shadow queue each request is copied to. Shadow responses are
+	// discarded after comparing them with the primary. Empty = off
+	Mirror string
+}
+
+const defaultPriorityAging = time.Second
+
+func (c QueueConfig) bodyLimit() int64 {
+	if c.MaxBodySize > 0 {
+		return c.MaxBodySize
+	}
+	return maxMessageSize
+}
+
+func (c QueueConfig) responseLimit() int64 {
+	if c.MaxResponseSize > 0 {
+		return c.MaxResponseSize
+	}
+	return maxMessageSize
+}
+
+func (c QueueConfig) allowsMethod(method string) bool {
+	if len(c.Methods) == 0 {
+		return true
+	}
+	for _, m := range c.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrNoBackend   = errors.New("no backend available for queue")
+	ErrQueueFull   = errors.New("queue is full")
+	ErrOverloaded  = errors.New("queue is overloaded")
+	ErrWaitTimeout = errors.New("timed out waiting for a backend")
+	ErrTimeout     = errors.New("request timed out")
+)
+
+func newQueue(conf QueueConfig) *queue {
+	return &queue{
+		conf: conf,
+		gen:  1,
+	}
+}
+
+// waiter is a request waiting on a queue to be taken by a backend
+type waiter struct {
+	req      *Request
+	enqueued time.Time
+
+	// receives once the request has been taken by a backend
+	taken chan bool
+
+	// backend version and consumer picked for the request, valid
+	// while gen matches the queue's gen
+	version string
+	target  *consumer
+	gen     int
+}
+
+// effectivePriority ages the request priority so low priority
+// requests are not starved by a steady stream of urgent ones
+func (w *waiter) effectivePriority(now time.Time, aging time.Duration) int {
+	return w.req.Priority + int(now.Sub(w.enqueued)/aging)
+}
+
+// consumer is a backend connection subscribed to one or more queues
+type consumer struct {
+	id      string
+	version string
+
+	// names of the queues the consumer is bound to, either directly
+	// or through one of its patterns. Guarded by Router.lock
+	queues []string
+
+	// glob patterns (see path.Match) the consumer subscribed with
+	patterns []string
+
+	// false while the connection is suspect. Guarded by Router.lock
+	healthy bool
+
+	// receives when there may be work to take
+	ready chan bool
+
+	// closed by Router.Destroy
+	done chan bool
+}
+
+func newConsumer(version string) *consumer {
+	return &consumer{
+		id:      RandHex(8),
+		version: version,
+		healthy: true,
+		ready:   make(chan bool, 1),
+		done:    make(chan bool),
+	}
+}
+
+// matches reports whether one of the consumer's patterns matches queue
+func (c *consumer) matches(queue string) bool {
+	for _, pattern := range c.patterns {
+		if ok, _ := path.Match(pattern, queue); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isPattern(subscription string) bool {
+	return strings.ContainsAny(subscription, "*?[")
+}
+
+func (c *consumer) wake() {
+	select {
+	case c.ready <- true:
+	default:
+	}
+}
+
+type queue struct {
+	conf QueueConfig
+
+	// backend connections subscribed to this queue by name
+	consumers []*consumer
+
+	// backend connections subscribed by a matching pattern. Only
+	// used while no consumer is subscribed by name
+	matched []*consumer
+
+	// requests waiting to be taken, in arrival order
+	waiting []*waiter
+
+	// bumped whenever consumers join, leave or change health, which
+	// invalidates the versions and targets picked for waiters
+	gen int
+
+	// time consumers last dropped to zero. The router's start time if
+	// the queue never had a consumer, so backends connecting just after
+	// the hub starts get the grace period, while queues nobody serves
+	// are rejected right away once it has passed
+	idle time.Time
+
+	// number of admitted requests not yet delivered
+	pending int
+
+	// CoDel state
+	firstAbove time.Time
+	dropping   bool
+}
+
+// admit reserves a pending slot for a new request, or returns
+// the reason the request must be shed. Caller must hold Router.lock
+func (q *queue) admit(now time.Time) error {
+	if len(q.active()) < 1 && now.Sub(q.idle) >= q.conf.NoBackendGrace {
+		return ErrNoBackend
+	}
+	if q.conf.MaxPending > 0 && q.pending >= q.conf.MaxPending {
+		return ErrQueueFull
+	}
+	if q.dropping {
+		return ErrOverloaded
+	}
+	q.pending++
+	return nil
+}
+
+// release frees the pending slot taken by admit. Caller must hold Router.lock
+func (q *queue) release() {
+	q.pending--
+	if q.pending == 0 {
+		// queue drained - delay can no longer be above target
+		q.firstAbove = time.Time{}
+		q.dropping = false
+	}
+}
+
+// push adds a waiter and wakes the consumers. Caller must hold Router.lock
+func (q *queue) push(w *waiter, now time.Time) {
+	w.enqueued = now
+	q.waiting = append(q.waiting, w)
+	for _, c := range q.active() {
+		c.wake()
+	}
+}
+
+// remove drops a waiter that has not been taken yet. Returns false
+// if it is no longer waiting. Caller must hold Router.lock
+func (q *queue) remove(w *waiter) bool {
+	for i, x := range q.waiting {
+		if x == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether c may take the waiter, given the backend
+// version and affinity target picked for it. Caller must hold Router.lock
+func (q *queue) accepts(w *waiter, c *consumer) bool {
+	if w.gen != q.gen {
+		q.route(w)
+	}
+	if w.version != "" && w.version != c.version {
+		return false
+	}
+	return w.target == nil || w.target == c
+}
+
+// route picks the backend version and, for requests with an
+// affinity key, the consumer for a waiter. Healthy consumers are
+// preferred. Caller must hold Router.lock
+func (q *queue) route(w *waiter) {
+	w.gen = q.gen
+	active := q.active()
+	w.version = q.conf.Split.pick(w.req.Version, active)
+	w.target = nil
+	if w.req.AffinityKey == "" {
+		return
+	}
+
+	candidates := make([]*consumer, 0, len(active))
+	fallback := make([]*consumer, 0, len(active))
+	for _, c := range active {
+		if w.version == "" || c.version == w.version {
+			fallback = append(fallback, c)
+			if c.healthy {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+	w.target = rendezvous(w.req.AffinityKey, candidates)
+}
+
+// changed invalidates affinity targets and wakes all consumers so
+// pinned requests are picked up by their new target. Caller must hold Router.lock
+func (q *queue) changed() {
+	q.gen++
+	for _, c := range q.consumers {
+		c.wake()
+	}
+	for _, c := range q.matched {
+		c.wake()
+	}
+}
+
+// active returns the consumers requests are dispatched to. Consumers
+// subscribed by name take precedence over pattern subscriptions.
+// Caller must hold Router.lock
+func (q *queue) active() []*consumer {
+	if len(q.consumers) > 0 {
+		return q.consumers
+	}
+	return q.matched
+}
+
+// serves reports whether c is one of the active consumers. Caller must hold Router.lock
+func (q *queue) serves(c *consumer) bool {
+	for _, x := range q.active() {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// best returns the index and effective priority of the waiter c
+// should take next, or -1 if none are waiting. Caller must hold Router.lock.
+//
+// Aging reorders waiters over time and each consumer may only take
+// some of them (see accepts), so best scans every waiter, re-routing
+// those whose routing is stale. A take is O(waiting) while holding
+// Router.lock, which all queues share: bound long queues with MaxPending
+func (q *queue) best(c *consumer, now time.Time) (int, int) {
+	aging := q.conf.PriorityAging
+	if aging <= 0 {
+		aging = defaultPriorityAging
+	}
+
+	idx, prio := -1, 0
+	if !q.serves(c) {
+		return idx, prio
+	}
+	for i, w := range q.waiting {
+		if !q.accepts(w, c) {
+			continue
+		}
+		p := w.effectivePriority(now, aging)
+		if idx < 0 || p > prio {
+			idx, prio = i, p
+		}
+	}
+	return idx, prio
+}
+
+// take removes the waiter at idx and signals it. Caller must hold Router.lock
+func (q *queue) take(idx int, now time.Time) *Request {
+	w := q.waiting[idx]
+	q.waiting = append(q.waiting[:idx], q.waiting[idx+1:]...)
+	q.delivered(now, now.Sub(w.enqueued))
+	w.taken <- true
+	return w.req
+}
+
+// delivered records the queueing delay of a request handed to a
+// backend. Caller must hold Router.lock
+func (q *queue) delivered(now time.Time, delay time.Duration) {
+	if q.conf.CodelTarget <= 0 {
+		return
+	}
+	if delay < q.conf.CodelTarget {
+		q.firstAbove = time.Time{}
+		q.dropping = false
+	} else if q.firstAbove.IsZero() {
+		q.firstAbove = now.Add(q.conf.CodelInterval)
+	} else if !now.Before(q.firstAbove) {
+		q.dropping = true
+	}
+}
+
+func (q *queue) subscribe(c *consumer) {
+	q.consumers = append(q.consumers, c)
+	q.changed()
+}
+
+func (q *queue) subscribePattern(c *consumer) {
+	q.matched = append(q.matched, c)
+	q.changed()
+}
+
+func removeConsumer(list []*consumer, c *consumer) []*consumer {
+	for i, x := range list {
+		if x == c {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func (q *queue) unsubscribe(c *consumer, now time.Time) {
+	q.consumers = removeConsumer(q.consumers, c)
+	q.matched = removeConsumer(q.matched, c)
+	if len(q.active()) == 0 {
+		q.idle = now
+	}
+	q.changed()
+}
@@ -0,0 +1,162 @@
+package retinaws
+
+import (
+	. "launchpad.net/gocheck"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type QueueSuite struct{}
+
+var _ = Suite(&QueueSuite{})
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (s *QueueSuite) TestNoBackendGraceFromStart(c *C) {
+	q := newQueue(QueueConfig{QueueLimits: QueueLimits{NoBackendGrace: 5 * time.Second}})
+	q.idle = start
+
+	c.Check(q.admit(start.Add(time.Second)), IsNil)
+	c.Check(q.admit(start.Add(5*time.Second)), Equals, ErrNoBackend)
+
+	q.subscribe(newConsumer(""))
+	c.Check(q.admit(start.Add(time.Minute)), IsNil)
+}
+
+func (s *QueueSuite) TestNoBackendGraceStartsAtRouterStart(c *C) {
+	r := NewRouter()
+	r.Defaults.NoBackendGrace = time.Minute
+	_, _, err := r.admit(&Request{Queue: "early"})
+	c.Check(err, IsNil)
+
+	r.started = time.Now().Add(-time.Hour)
+	_, _, err = r.admit(&Request{Queue: "late"})
+	c.Check(err, Equals, ErrNoBackend)
+}
+
+func (s *QueueSuite) TestMaxPending(c *C) {
+	q := newQueue(QueueConfig{QueueLimits: QueueLimits{MaxPending: 2}})
+	q.subscribe(newConsumer(""))
+
+	c.Check(q.admit(start), IsNil)
+	c.Check(q.admit(start), IsNil)
+	c.Check(q.admit(start), Equals, ErrQueueFull)
+	q.release()
+	c.Check(q.admit(start), IsNil)
+	c.Check(q.pending, Equals, 2)
+}
+
+func (s *QueueSuite) TestCodelSheds(c *C) {
+	q := newQueue(QueueConfig{QueueLimits: QueueLimits{
+		CodelTarget:   10 * time.Millisecond,
+		CodelInterval: 100 * time.Millisecond,
+	}})
+	q.subscribe(newConsumer(""))
+	c.Assert(q.admit(start), IsNil)
+
+	// delay above target for less than an interval is tolerated
+	q.delivered(start, 20*time.Millisecond)
+	q.delivered(start.Add(99*time.Millisecond), 20*time.Millisecond)
+	c.Check(q.admit(start.Add(99*time.Millisecond)), IsNil)
+
+	// for a whole interval it is not
+	q.delivered(start.Add(100*time.Millisecond), 20*time.Millisecond)
+	c.Check(q.admit(start.Add(100*time.Millisecond)), Equals, ErrOverloaded)
+
+	// until a request is delivered below target
+	q.delivered(start.Add(150*time.Millisecond), 5*time.Millisecond)
+	c.Check(q.admit(start.Add(150*time.Millisecond)), IsNil)
+
+	// or the queue drains
+	q.delivered(start.Add(200*time.Millisecond), 20*time.Millisecond)
+	q.delivered(start.Add(300*time.Millisecond), 20*time.Millisecond)
+	c.Check(q.admit(start.Add(300*time.Millisecond)), Equals, ErrOverloaded)
+	for q.pending > 0 {
+		q.release()
+	}
+	c.Check(q.admit(start.Add(300*time.Millisecond)), IsNil)
+}
+
+func (s *QueueSuite) TestDeliverTimeouts(c *C) {
+	r := NewRouter()
+	r.register([]string{"busy"}, "")
+
+	// a backend that never takes the request: MaxWait sheds it with a
+	// 503, the request deadline with a 504
+	deliver := func(maxWait time.Duration) error {
+		r.Configure("busy", QueueConfig{QueueLimits: QueueLimits{MaxWait: maxWait}})
+		req := &Request{Queue: "busy", Ack: make(chan bool, 1), Deadline: time.Now().Add(50 * time.Millisecond)}
+		q, limits, err := r.admit(req)
+		c.Assert(err, IsNil)
+		return r.deliver(q, limits, req)
+	}
+	c.Check(deliver(10*time.Millisecond), Equals, ErrWaitTimeout)
+	c.Check(deliver(0), Equals, ErrTimeout)
+	c.Check(deliver(time.Second), Equals, ErrTimeout)
+}
+
+// waiting pushes a request with the given priority at enqueued
+func waiting(q *queue, priority int, affinityKey string, enqueued time.Time) {
+	req := &Request{Priority: priority, AffinityKey: affinityKey}
+	q.push(&waiter{req: req, taken: make(chan bool, 1)}, enqueued)
+}
+
+func (s *QueueSuite) TestBestPrefersHigherPriority(c *C) {
+	q := newQueue(QueueConfig{PriorityAging: time.Second})
+	consumer := newConsumer("")
+	q.subscribe(consumer)
+
+	waiting(q, 0, "", start)
+	waiting(q, 5, "", start.Add(10*time.Millisecond))
+	waiting(q, 5, "", start.Add(20*time.Millisecond))
+	idx, prio := q.best(consumer, start.Add(30*time.Millisecond))
+	c.Check(idx, Equals, 1)
+	c.Check(prio, Equals, 5)
+
+	// the oldest of equal priority goes first
+	c.Check(q.take(idx, start.Add(30*time.Millisecond)).Priority, Equals, 5)
+	idx, _ = q.best(consumer, start.Add(30*time.Millisecond))
+	c.Check(idx, Equals, 1)
+
+	idx, _ = q.best(newConsumer(""), start)
+	c.Check(idx, Equals, -1)
+}
+
+func (s *QueueSuite) TestBestAgesWaiters(c *C) {
+	// low priority work gains a level per second waiting, so it is
+	// not starved by more urgent work that keeps arriving
+	urgent := func(waited time.Duration) int {
+		q := newQueue(QueueConfig{PriorityAging: time.Second})
+		consumer := newConsumer("")
+		q.subscribe(consumer)
+		waiting(q, 0, "", start)
+		waiting(q, 3, "", start.Add(waited))
+		idx, _ := q.best(consumer, start.Add(waited))
+		return idx
+	}
+	c.Check(urgent(2*time.Second), Equals, 1)
+	c.Check(urgent(4*time.Second), Equals, 0)
+
+	q := newQueue(QueueConfig{PriorityAging: time.Second})
+	consumer := newConsumer("")
+	q.subscribe(consumer)
+	waiting(q, 1, "", start)
+	idx, prio := q.best(consumer, start.Add(2500*time.Millisecond))
+	c.Check(idx, Equals, 0)
+	c.Check(prio, Equals, 3)
+}
+
+func (s *QueueSuite) TestBestSkipsWaitersPinnedElsewhere(c *C) {
+	q := newQueue(QueueConfig{})
+	a, b := newConsumer(""), newConsumer("")
+	q.subscribe(a)
+	q.subscribe(b)
+
+	waiting(q, 0, "user1", start)
+	idxA, _ := q.best(a, start)
+	idxB, _ := q.best(b, start)
+	c.Check(idxA+idxB, Equals, -1)
+}
@@ -0,0 +1,79 @@
+package retinaws
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PriorityPolicy decides the priority of requests arriving on a
+// route. Higher values are dispatched first
+type PriorityPolicy struct {
+	// Header clients may set the priority with. Empty = clients
+	// cannot choose and every request gets Default
+	Header string
+
+	// Client supplied values are clamped to this range
+	Min int
+	Max int
+
+	Default int
+}
+
+func (p PriorityPolicy) priority(hr *http.Request) int {
+	if p.Header == "" {
+		return p.Default
+	}
+	val := strings.TrimSpace(hr.Header.Get(p.Header))
+	if val == "" {
+		return p.Default
+	}
+	prio, err := strconv.Atoi(val)
+	if err != nil {
+		return p.Default
+	}
+	if prio < p.Min {
+		prio = p.Min
+	} else if prio > p.Max {
+		prio = p.Max
+	}
+	return prio
+}
+
+// Route serves a vhost path through a hub with per-route settings.
+// External.ServeHTTP behaves like a Route with zero settings
+type Route struct {
+	External *External
+
+	// Queue requests are sent to. Empty = the {queue} path variable
+	Queue string
+
+	// Name of the vhost the route belongs to, passed to backends in
+	// X-Hub-Vhost. Empty = the request Host
+	Vhost string
+
+	Priority PriorityPolicy
+}
+
+// queue returns the queue for req and the path variables to pass
+// to the backend
+func (me *Route) queue(req *http.Request) (string, map[string]string) {
+	vars := mux.Vars(req)
+	if me.Queue != "" {
+		return me.Queue, vars
+	}
+
+	queue := vars["queue"]
+	params := make(map[string]string, len(vars))
+	for name, val := range vars {
+		if name != "queue" {
+			params[name] = val
+		}
+	}
+	return queue, params
+}
+
+func (me *Route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	me.External.serve(w, req, me)
+}
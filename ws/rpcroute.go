@@ -0,0 +1,200 @@
+package retinaws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RPCRoute serves JSON-RPC 2.0 requests through a hub, routing each
+// call by its method. A method's queue is looked up in Methods, then
+// taken from the method name up to the first dot (users.get goes to
+// queue users), and otherwise is Route.Queue.
+//
+// Each call is sent to its backend as its own request, with the
+// single call envelope as the body and the method in X-Hub-Rpc-Method,
+// so backends can serve them with JSONRPC. The calls in a batch are
+// sent concurrently and the responses returned in request order.
+// Notifications are sent without waiting for the backend. Queues
+// configured as Async take only notifications
+type RPCRoute struct {
+	Route
+
+	// Queue by method name, overriding the name prefix
+	Methods map[string]string
+
+	// Most calls in a batch. 0 = 100
+	MaxBatch int
+}
+
+const defaultMaxBatch = 100
+
+func (me *RPCRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := RandHex(8)
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, me.bodyLimit()))
+	if err != nil {
+		e := newError(413, CodeBodyTooLarge, "request body too large")
+		e.RequestID = id
+		writeError(w, req, e)
+		return
+	}
+
+	var reply interface{}
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		reply = rpcErrorResponse(nil, &RPCError{Code: RPCParseError, Message: "parse error"})
+	} else if body[0] == '[' {
+		var batch []json.RawMessage
+		json.Unmarshal(body, &batch)
+		if len(batch) == 0 || len(batch) > me.maxBatch() {
+			reply = rpcErrorResponse(nil, &RPCError{Code: RPCInvalidRequest, Message: "batch must hold 1 to " + strconv.Itoa(me.maxBatch()) + " calls"})
+		} else if responses := me.batch(req, id, batch); len(responses) > 0 {
+			reply = responses
+		}
+	} else if resp := me.call(req, id, body); resp != nil {
+		reply = resp
+	}
+
+	w.Header().Set("X-Request-Id", id)
+	if reply == nil {
+		w.WriteHeader(204)
+		return
+	}
+	data, _ := json.Marshal(reply)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (me *RPCRoute) maxBatch() int {
+	if me.MaxBatch > 0 {
+		return me.MaxBatch
+	}
+	return defaultMaxBatch
+}
+
+// batch sends the calls concurrently and returns their responses in order
+func (me *RPCRoute) batch(req *http.Request, id string, batch []json.RawMessage) []json.RawMessage {
+	results := make([]json.RawMessage, len(batch))
+	wg := sync.WaitGroup{}
+	for i, raw := range batch {
+		wg.Add(1)
+		go func(i int, raw json.RawMessage) {
+			defer wg.Done()
+			results[i] = me.call(req, id+"-"+strconv.Itoa(i), raw)
+		}(i, raw)
+	}
+	wg.Wait()
+
+	responses := make([]json.RawMessage, 0, len(results))
+	for _, resp := range results {
+		if resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	return responses
+}
+
+// call sends one call to its queue and returns the response, or nil
+// for notifications
+func (me *RPCRoute) call(hr *http.Request, id string, raw json.RawMessage) json.RawMessage {
+	var call RPCRequest
+	if err := json.Unmarshal(raw, &call); err != nil || call.JSONRPC != "2.0" || call.Method == "" {
+		return rpcMarshal(rpcErrorResponse(call.ID, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"}))
+	}
+	fail := func(e *HubError) json.RawMessage {
+		if call.IsNotification() {
+			return nil
+		}
+		return rpcMarshal(rpcErrorResponse(call.ID, rpcError(context.Background(), e)))
+	}
+
+	queue := me.queueFor(call.Method)
+	if queue == "" {
+		if call.IsNotification() {
+			return nil
+		}
+		return rpcMarshal(rpcErrorResponse(call.ID, &RPCError{Code: RPCMethodNotFound, Message: "method not found: " + call.Method}))
+	}
+	conf := me.External.Router.Config(queue)
+	if !conf.allowsMethod("POST") {
+		return fail(newError(405, CodeMethodNotAllowed, "method not allowed on queue: "+queue))
+	}
+	if int64(len(raw)) > conf.bodyLimit() {
+		return fail(newError(413, CodeBodyTooLarge, "request body too large"))
+	}
+	if conf.Async && !call.IsNotification() {
+		// the backend's reply is never returned, only a 202 from the hub
+		return fail(newError(400, CodeBadRequest, "async queue takes only notifications: "+queue))
+	}
+
+	r, err := me.External.fromHttpRequest(id, queue, nil, rpcRequest(hr, raw), &me.Route, conf)
+	if err != nil {
+		return fail(newError(400, CodeBadRequest, err.Error()))
+	}
+	r.Headers["X-Hub-Rpc-Method"] = []string{call.Method}
+
+	if call.IsNotification() {
+		go func() {
+			me.External.dispatch(r, conf).readAll()
+		}()
+		return nil
+	}
+
+	resp := me.External.dispatch(r, conf)
+	resp.readAll()
+	if resp.Error != nil {
+		return fail(resp.Error)
+	}
+	body := bytes.TrimSpace(resp.Body)
+	if len(body) == 0 || body[0] != '{' || !json.Valid(body) {
+		return fail(newError(502, CodeBackendError, "invalid JSON-RPC response from queue: "+queue))
+	}
+	return body
+}
+
+// bodyLimit returns the largest request body read: the limit of the
+// route's queue, or of a queue in Methods if larger. Each call is
+// checked against the limit of its own queue once the body is parsed.
+// Queues reached by method prefix are not known in advance, so one
+// taking larger bodies than the route's queue needs a Methods entry
+func (me *RPCRoute) bodyLimit() int64 {
+	limit := me.External.Router.Config(me.Queue).bodyLimit()
+	for _, queue := range me.Methods {
+		if n := me.External.Router.Config(queue).bodyLimit(); n > limit {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// queueFor returns the queue serving method
+func (me *RPCRoute) queueFor(method string) string {
+	if queue, ok := me.Methods[method]; ok {
+		return queue
+	}
+	if i := strings.Index(method, "."); i > 0 {
+		return method[:i]
+	}
+	return me.Queue
+}
+
+// rpcRequest returns a copy of hr carrying one call of a batch
+func rpcRequest(hr *http.Request, raw json.RawMessage) *http.Request {
+	r := hr.Clone(hr.Context())
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	r.ContentLength = int64(len(raw))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Length", strconv.Itoa(len(raw)))
+	return r
+}
+
+func rpcMarshal(resp *RPCResponse) json.RawMessage {
+	data, _ := json.Marshal(resp)
+	return data
+}
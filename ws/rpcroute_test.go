@@ -0,0 +1,50 @@
+package retinaws
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http/httptest"
+	"strings"
+)
+
+type RPCSuite struct{}
+
+var _ = Suite(&RPCSuite{})
+
+func (s *RPCSuite) TestBodyLimitOfTargetQueue(c *C) {
+	router := NewRouter()
+	router.Configure("rpc", QueueConfig{MaxBodySize: 100})
+	router.Configure("uploads", QueueConfig{MaxBodySize: 1000})
+	route := &RPCRoute{Route: Route{External: &External{Router: router}, Queue: "rpc"}}
+
+	post := func(method string, size int) int {
+		body := `{"jsonrpc":"2.0","method":"` + method + `","params":"` + strings.Repeat("x", size) + `","id":1}`
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, httptest.NewRequest("POST", "/rpc", strings.NewReader(body)))
+		return w.Code
+	}
+	// nothing is connected, so calls within the limit get an RPC error
+	c.Check(post("add", 20), Equals, 200)
+	c.Check(post("add", 200), Equals, 413)
+
+	// until a queue named in Methods takes larger bodies, which are
+	// then checked per call
+	route.Methods = map[string]string{"upload": "uploads"}
+	c.Check(post("upload", 200), Equals, 200)
+	c.Check(post("add", 200), Equals, 200)
+	c.Check(post("upload", 2000), Equals, 413)
+}
+
+func (s *RPCSuite) TestAsyncQueueTakesOnlyNotifications(c *C) {
+	router := NewRouter()
+	router.Configure("events", QueueConfig{Async: true})
+	route := &RPCRoute{Route: Route{External: &External{Router: router}, Queue: "rpc"}}
+
+	w := httptest.NewRecorder()
+	route.ServeHTTP(w, httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc":"2.0","method":"events.add","id":1}`)))
+	c.Check(w.Code, Equals, 200)
+	c.Check(strings.Contains(w.Body.String(), "async queue takes only notifications: events"), Equals, true, Commentf(w.Body.String()))
+
+	w = httptest.NewRecorder()
+	route.ServeHTTP(w, httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc":"2.0","method":"events.add"}`)))
+	c.Check(w.Code, Equals, 204)
+}
@@ -0,0 +1,70 @@
+package retinaws
+
+import (
+	"math/rand"
+	"net/http"
+)
+
+// VersionMatch sends requests carrying Header to backends that
+// registered with Version. An empty Value matches any value
+type VersionMatch struct {
+	Header  string
+	Value   string
+	Version string
+}
+
+// TrafficSplit divides a queue's requests between backend versions
+type TrafficSplit struct {
+	// Relative weight per backend version, e.g. {"v1": 95, "v2": 5}.
+	// Versions without a weight only get traffic when no weighted
+	// version is connected
+	Weights map[string]int
+
+	// Checked in order before Weights
+	Match []VersionMatch
+}
+
+// version returns the version requested by a header match, or ""
+func (s TrafficSplit) version(hr *http.Request) string {
+	for _, m := range s.Match {
+		val := hr.Header.Get(m.Header)
+		if val != "" && (m.Value == "" || m.Value == val) {
+			return m.Version
+		}
+	}
+	return ""
+}
+
+// pick chooses the version a request should go to among the
+// versions of the connected consumers. "" means any consumer
+func (s TrafficSplit) pick(requested string, consumers []*consumer) string {
+	present := make(map[string]bool)
+	for _, c := range consumers {
+		present[c.version] = true
+	}
+
+	if requested != "" && present[requested] {
+		return requested
+	}
+
+	total := 0
+	for version, weight := range s.Weights {
+		if weight > 0 && present[version] {
+			total += weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+
+	n := rand.Intn(total)
+	for version, weight := range s.Weights {
+		if weight > 0 && present[version] {
+			if n < weight {
+				return version
+			}
+			n -= weight
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package retinaws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validator is implemented by request types that check their own
+// fields. JSONHandler replies 400 if Validate returns an error
+type Validator interface {
+	Validate() error
+}
+
+type headersKey struct{}
+
+// RequestHeaders returns the hub headers of the request a typed
+// handler is serving, e.g. to pass as parent to Backend.Call
+func RequestHeaders(ctx context.Context) map[string][]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string][]string)
+	return headers
+}
+
+// handlerContext returns a context carrying headers that ends at the
+// request's X-Hub-Deadline
+func handlerContext(headers map[string][]string) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), headersKey{}, headers)
+	if ms, err := strconv.ParseInt(firstHeader(headers, "X-Hub-Deadline"), 10, 64); err == nil {
+		return context.WithDeadline(ctx, time.Unix(0, ms*int64(time.Millisecond)))
+	}
+	return context.WithCancel(ctx)
+}
+
+// JSONHandler adapts fn to a MessageHandler that decodes the request
+// body as JSON into Req and encodes the Resp returned as JSON. An
+// empty body decodes to the zero Req.
+//
+// Requests with a non-JSON Content-Type get a 415 reply, and those
+// whose Accept excludes JSON a 406. Undecodable or invalid (see
+// Validator) requests get a 400. A *HubError returned by fn is sent
+// with its status and code; other errors are sent as 500
+// internal_error, or 504 timeout if the deadline passed
+func JSONHandler[Req, Resp any](fn func(ctx context.Context, req Req) (Resp, error)) MessageHandler {
+	return func(headers map[string][]string, body []byte) (map[string][]string, []byte) {
+		if e := negotiateJSON(headers); e != nil {
+			return e.Headers(), nil
+		}
+		req, err := decodeJSON[Req](body)
+		if err != nil {
+			return newError(400, CodeBadRequest, err.Error()).Headers(), nil
+		}
+
+		ctx, cancel := handlerContext(headers)
+		defer cancel()
+		resp, err := fn(ctx, req)
+		if err != nil {
+			return handlerError(ctx, err).Headers(), nil
+		}
+
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return newError(500, CodeInternal, "cannot encode response: "+err.Error()).Headers(), nil
+		}
+		return map[string][]string{
+			"X-Hub-Status": []string{"200"},
+			"Content-Type": []string{"application/json"},
+		}, data
+	}
+}
+
+// negotiateJSON checks the request's Content-Type and Accept allow JSON
+func negotiateJSON(headers map[string][]string) *HubError {
+	if ct := firstHeader(headers, "Content-Type"); ct != "" {
+		if mediaType, _, err := mime.ParseMediaType(ct); err != nil || !isJSON(mediaType) {
+			return newError(415, CodeUnsupportedMediaType, "content type must be application/json: "+ct)
+		}
+	}
+
+	accept := strings.Join(headers["Accept"], ",")
+	if accept == "" {
+		return nil
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if isJSON(mediaType) || mediaType == "*/*" || mediaType == "application/*" {
+			return nil
+		}
+	}
+	return newError(406, CodeNotAcceptable, "response is application/json, not acceptable: "+accept)
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeJSON decodes data into a Req and validates it
+func decodeJSON[Req any](data []byte) (Req, error) {
+	var req Req
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return req, errors.New("invalid JSON: " + err.Error())
+		}
+	}
+	// the pointer's method set includes Validate methods on Req values
+	if v, ok := interface{}(&req).(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// handlerError returns the error reply for an error from a typed handler
+func handlerError(ctx context.Context, err error) *HubError {
+	var e *HubError
+	if errors.As(err, &e) {
+		if e.Status == 0 {
+			copied := *e
+			copied.Status = 500
+			return &copied
+		}
+		return e
+	}
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+		return newError(504, CodeTimeout, err.Error())
+	}
+	return newError(500, CodeInternal, err.Error())
+}